@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sushant12/machine/pkg/firecracker"
+)
+
+const (
+	AutoStopModeStop  = "stop"
+	AutoStopModePause = "pause"
+)
+
+// agentReadyTimeout bounds how long a woken machine may take until its
+// agent reports OK.
+const agentReadyTimeout = 60 * time.Second
+
+var errMachineNotFound = errors.New("machine not found")
+
+// AutoStop stops or pauses a machine once it has had no proxied traffic or
+// exec calls for IdleMinutes. The machine is started again by the next
+// request for it.
+type AutoStop struct {
+	IdleMinutes int    `json:"idle_minutes"`
+	Mode        string `json:"mode,omitempty"`
+}
+
+func (a AutoStop) Enabled() bool {
+	return a.IdleMinutes > 0
+}
+
+func (a AutoStop) Validate() error {
+	if a.IdleMinutes < 0 {
+		return fmt.Errorf("auto_stop idle_minutes must not be negative")
+	}
+	switch a.Mode {
+	case "", AutoStopModeStop, AutoStopModePause:
+		return nil
+	default:
+		return fmt.Errorf("unknown auto_stop mode %q", a.Mode)
+	}
+}
+
+// acquireMachine marks the machine busy so it isn't stopped while a request
+// is being served, waking it first if auto-stop suspended it. Every
+// successful call must be paired with releaseMachine.
+func acquireMachine(ctx context.Context, machineID string) error {
+	var lifecycle *sync.Mutex
+	ok := machines.update(machineID, func(m *Machine) {
+		m.active++
+		m.LastActivity = time.Now()
+		lifecycle = m.lifecycle
+	})
+	if !ok {
+		return fmt.Errorf("%w: %s", errMachineNotFound, machineID)
+	}
+
+	lifecycle.Lock()
+	err := wakeMachine(ctx, machineID)
+	lifecycle.Unlock()
+	if err != nil {
+		releaseMachine(machineID)
+	}
+	return err
+}
+
+func releaseMachine(machineID string) {
+	machines.update(machineID, func(m *Machine) {
+		m.active--
+		m.LastActivity = time.Now()
+	})
+}
+
+// wakeMachine starts or resumes the machine if auto-stop suspended it and
+// waits for its agent. It fails unless the machine ends up running. The
+// caller holds the machine's lifecycle lock.
+func wakeMachine(ctx context.Context, machineID string) error {
+	m, ok := machines.get(machineID)
+	if !ok {
+		return fmt.Errorf("%w: %s", errMachineNotFound, machineID)
+	}
+	if m.State == StateStarted {
+		return nil
+	}
+	if m.AutoStop == nil || (m.State != StateStopped && m.State != StatePaused) {
+		return fmt.Errorf("machine %s is %s", machineID, m.State)
+	}
+
+	logrus.Infof("Waking %s machine %s", m.State, machineID)
+	machines.update(machineID, func(m *Machine) {
+		m.State = StateStarting
+	})
+
+	if m.State == StatePaused {
+		if err := resumeMachine(ctx, machineID); err != nil {
+			// Stopping the machine would lose its memory, leave it paused
+			// so the next request tries again.
+			machines.update(machineID, func(m *Machine) {
+				if m.State == StateStarting {
+					m.State = StatePaused
+				}
+			})
+			return fmt.Errorf("waking machine %s: %w", machineID, err)
+		}
+		if err := waitForAgent(ctx, machineID); err != nil {
+			// The machine runs again, auto-stop pauses it once it is idle.
+			machines.update(machineID, func(m *Machine) {
+				if m.State == StateStarting {
+					m.State = StateStarted
+				}
+			})
+			return fmt.Errorf("waking machine %s: %w", machineID, err)
+		}
+	} else {
+		err := relaunchMachine(machineID)
+		if err == nil {
+			err = waitForAgent(ctx, machineID)
+		}
+		if err != nil {
+			// Leave the machine stopped so the next request tries again.
+			stopMachine(machineID)
+			return fmt.Errorf("waking machine %s: %w", machineID, err)
+		}
+	}
+
+	machines.update(machineID, func(m *Machine) {
+		if m.State == StateStarting {
+			m.State = StateStarted
+		}
+	})
+	return nil
+}
+
+// resumeMachine resumes a paused machine, retrying once if Firecracker
+// fails to.
+func resumeMachine(ctx context.Context, machineID string) error {
+	socketPath := filepath.Join("/tmp", fmt.Sprintf("firecracker-%s.socket", machineID))
+	client := firecracker.NewClient(socketPath)
+	err := client.PatchVMState(ctx, "Resumed")
+	if err == nil {
+		return nil
+	}
+	logrus.WithError(err).Warnf("Failed to resume machine %s, retrying", machineID)
+	return client.PatchVMState(ctx, "Resumed")
+}
+
+// relaunchMachine boots a stopped machine again from its rootfs. The config
+// file is written again from the machine's record, so rate limits changed
+// while it ran are kept.
+func relaunchMachine(machineID string) error {
+	m, ok := machines.get(machineID)
+	if !ok {
+		return fmt.Errorf("%w: %s", errMachineNotFound, machineID)
+	}
+
+	machineDir := filepath.Join(".", machineID)
+	socketPath := filepath.Join("/tmp", fmt.Sprintf("firecracker-%s.socket", machineID))
+	vsockPath := filepath.Join("/tmp", fmt.Sprintf("firecracker-vsock-%s.sock", machineID))
+	configFilePath := filepath.Join("/tmp", fmt.Sprintf("firecracker-config-%s.json", machineID))
+
+	// Firecracker refuses to start while the previous sockets are around.
+	for _, path := range []string{socketPath, vsockPath} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+
+	vmConfig := m.config
+	vmConfig.Config.Guest.RateLimits = m.RateLimits
+	cmd, err := startFirecrackerInstance(vmConfig, networks.Leases(machineID), machineDir, socketPath, vsockPath, configFilePath)
+	if err != nil {
+		return err
+	}
+	exited := make(chan struct{})
+	go watchMachine(machineID, cmd, exited)
+	registered := machines.update(machineID, func(m *Machine) {
+		m.cmd = cmd
+		m.exited = exited
+	})
+	if !registered {
+		stopFirecracker(cmd, exited, 10*time.Second)
+		return fmt.Errorf("%w: %s", errMachineNotFound, machineID)
+	}
+	return nil
+}
+
+// waitForAgent polls the agent's /v1/status until it reports OK.
+func waitForAgent(ctx context.Context, machineID string) error {
+	ctx, cancel := context.WithTimeout(ctx, agentReadyTimeout)
+	defer cancel()
+
+	vsockPath := filepath.Join("/tmp", fmt.Sprintf("firecracker-vsock-%s.sock", machineID))
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		m, ok := machines.get(machineID)
+		if !ok || m.State != StateStarting {
+			return fmt.Errorf("machine exited while starting")
+		}
+		if body, err := getVMStatus(vsockPath); err == nil {
+			var status VMStatus
+			if json.Unmarshal([]byte(body), &status) == nil && status.OK {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for agent: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// stopMachine stops the machine's Firecracker process and records it as
+// stopped.
+func stopMachine(machineID string) {
+	m, ok := machines.get(machineID)
+	if !ok {
+		return
+	}
+	stopFirecracker(m.cmd, m.exited, 10*time.Second)
+	// Record the stop right away rather than waiting for watchMachine, so
+	// the next wake doesn't see a stale state.
+	machines.update(machineID, func(rec *Machine) {
+		if rec.cmd != m.cmd {
+			return
+		}
+		rec.State = StateStopped
+		rec.cmd = nil
+		rec.exited = nil
+	})
+}
+
+// autoStopIdleMachines periodically suspends machines that have been idle
+// for longer than their auto-stop timeout.
+func autoStopIdleMachines(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, m := range machines.list() {
+			if m.AutoStop != nil && m.State == StateStarted && m.idleFor() >= m.AutoStop.idleTimeout() {
+				suspendMachine(m.ID)
+			}
+		}
+	}
+}
+
+func (m Machine) idleFor() time.Duration {
+	if m.active > 0 {
+		return 0
+	}
+	return time.Since(m.LastActivity)
+}
+
+func (a AutoStop) idleTimeout() time.Duration {
+	return time.Duration(a.IdleMinutes) * time.Minute
+}
+
+func suspendMachine(machineID string) {
+	m, ok := machines.get(machineID)
+	if !ok {
+		return
+	}
+	m.lifecycle.Lock()
+	defer m.lifecycle.Unlock()
+
+	// Requests may have come in since the machine was found idle.
+	m, ok = machines.get(machineID)
+	if !ok || m.State != StateStarted || m.idleFor() < m.AutoStop.idleTimeout() {
+		return
+	}
+
+	if m.AutoStop.Mode == AutoStopModePause {
+		logrus.Infof("Pausing idle machine %s", machineID)
+		socketPath := filepath.Join("/tmp", fmt.Sprintf("firecracker-%s.socket", machineID))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := firecracker.NewClient(socketPath).PatchVMState(ctx, "Paused"); err != nil {
+			logrus.WithError(err).Errorf("Failed to pause machine %s", machineID)
+			return
+		}
+		machines.update(machineID, func(m *Machine) {
+			m.State = StatePaused
+		})
+		return
+	}
+
+	logrus.Infof("Stopping idle machine %s", machineID)
+	stopMachine(machineID)
+}
@@ -12,6 +12,8 @@ func main() {
 	inputDir := flag.String("input", "", "Input directory containing the root filesystem")
 	outputImage := flag.String("output", "rootfs.img", "Output ext4 image path")
 	size := flag.Int("size", 0, "Size of the image in MB (optional, will be calculated if not specified)")
+	headroom := flag.Int("headroom", rootfs.DefaultHeadroomMB, "Free space in MB to leave in the image when its size is calculated")
+	method := flag.String("method", string(rootfs.BuildMkfs), "How to populate the image: mkfs (mkfs.ext4 -d, no privileges needed) or mount (sudo mount and cp)")
 	flag.Parse()
 
 	if *inputDir == "" {
@@ -20,8 +22,20 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err := rootfs.CreateExt4Image(*inputDir, *outputImage, *size); err != nil {
+	if *size == 0 {
+		var err error
+		if *size, err = rootfs.ImageSizeMB(*inputDir, *headroom); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := rootfs.CreateExt4Image(*inputDir, *outputImage, *size, rootfs.BuildMethod(*method)); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
+
+	if usage, err := rootfs.FileDiskUsage(*outputImage); err == nil {
+		fmt.Printf("%s: %d MB apparent, %d MB allocated\n", *outputImage, usage.ApparentBytes>>20, usage.AllocatedBytes>>20)
+	}
 }
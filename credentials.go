@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errCredentialNotFound = errors.New("credential not found")
+	errCredentialExists   = errors.New("credential already exists")
+)
+
+// RegistryAuth authenticates a single image pull, either with a username
+// and password, a bearer token or a stored credential.
+type RegistryAuth struct {
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"password,omitempty"`
+	Token      string `json:"token,omitempty"`
+	Credential string `json:"credential,omitempty"`
+}
+
+// String keeps secrets out of logs.
+func (a RegistryAuth) String() string {
+	if a.Credential != "" {
+		return fmt.Sprintf("{credential:%s}", a.Credential)
+	}
+	if a.Empty() {
+		return "{}"
+	}
+	return "{redacted}"
+}
+
+func (a RegistryAuth) Empty() bool {
+	return a == RegistryAuth{}
+}
+
+func (a RegistryAuth) Validate() error {
+	kinds := 0
+	if a.Username != "" || a.Password != "" {
+		if a.Username == "" || a.Password == "" {
+			return fmt.Errorf("registry_auth needs both username and password")
+		}
+		kinds++
+	}
+	if a.Token != "" {
+		kinds++
+	}
+	if a.Credential != "" {
+		kinds++
+	}
+	if kinds > 1 {
+		return fmt.Errorf("registry_auth takes one of username and password, token or credential")
+	}
+	return nil
+}
+
+// Authenticator returns the authenticator for pulling image, or nil if the
+// server's default credentials should be used.
+func (a RegistryAuth) Authenticator(image string) (authn.Authenticator, error) {
+	switch {
+	case a.Credential != "":
+		c, ok := credentials.get(a.Credential)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errCredentialNotFound, a.Credential)
+		}
+		if c.Registry != "" {
+			ref, err := name.ParseReference(image)
+			if err != nil {
+				return nil, fmt.Errorf("parsing image reference: %w", err)
+			}
+			// Both sides are normalized, so docker.io matches
+			// index.docker.io.
+			if ref.Context().RegistryStr() != c.Registry {
+				return nil, fmt.Errorf("credential %s is for %s, not %s", c.Name, c.Registry, ref.Context().RegistryStr())
+			}
+		}
+		return c.auth().Authenticator(image)
+	case a.Token != "":
+		return &authn.Bearer{Token: a.Token}, nil
+	case a.Username != "":
+		return &authn.Basic{Username: a.Username, Password: a.Password}, nil
+	}
+	return nil, nil
+}
+
+// Credential is registry auth stored on the server, so machine configs can
+// refer to it by name instead of carrying secrets.
+type Credential struct {
+	Name string `json:"name"`
+	// Registry restricts the credential to images on one registry, such
+	// as ghcr.io or docker.io. It is stored normalized, docker.io becomes
+	// index.docker.io.
+	Registry string `json:"registry,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+func (c Credential) auth() RegistryAuth {
+	return RegistryAuth{Username: c.Username, Password: c.Password, Token: c.Token}
+}
+
+// redacted returns the credential without its secrets.
+func (c Credential) redacted() Credential {
+	return Credential{Name: c.Name, Registry: c.Registry, Username: c.Username}
+}
+
+type credentialStore struct {
+	mu          sync.Mutex
+	credentials map[string]Credential
+}
+
+var credentials = &credentialStore{credentials: map[string]Credential{}}
+
+func (s *credentialStore) add(c Credential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.credentials[c.Name]; ok {
+		return fmt.Errorf("%w: %s", errCredentialExists, c.Name)
+	}
+	s.credentials[c.Name] = c
+	return nil
+}
+
+func (s *credentialStore) get(name string) (Credential, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.credentials[name]
+	return c, ok
+}
+
+func (s *credentialStore) list() []Credential {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]Credential, 0, len(s.credentials))
+	for _, c := range s.credentials {
+		list = append(list, c.redacted())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (s *credentialStore) remove(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.credentials[name]
+	delete(s.credentials, name)
+	return ok
+}
+
+// @Summary Store a registry credential
+// @Description Stores registry auth under a name that machine configs can refer to with registry_auth.credential. Secrets are never returned by the API.
+// @Accept json
+// @Produce json
+// @Param credential body Credential true "Credential"
+// @Success 200 {object} Credential "Stored credential without secrets"
+// @Failure 400 {string} string "Bad Request"
+// @Failure 409 {string} string "Conflict"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /credentials [post]
+func createCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	var c Credential
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		logrus.WithError(err).Error("Failed to decode JSON")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if c.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	auth := c.auth()
+	if auth.Empty() {
+		http.Error(w, "username and password or token are required", http.StatusBadRequest)
+		return
+	}
+	if err := auth.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if c.Registry != "" {
+		registry, err := name.NewRegistry(c.Registry)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid registry: %v", err), http.StatusBadRequest)
+			return
+		}
+		c.Registry = registry.RegistryStr()
+	}
+
+	if err := credentials.add(c); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	responseJSON, err := json.Marshal(c.redacted())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to marshal response JSON")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+// @Summary List registry credentials
+// @Description Lists stored registry credentials without their secrets
+// @Produce json
+// @Success 200 {array} Credential "Credentials"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /credentials [get]
+func listCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	responseJSON, err := json.Marshal(credentials.list())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to marshal response JSON")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+// @Summary Delete a registry credential
+// @Description Removes a stored registry credential
+// @Param name path string true "Credential name"
+// @Success 204 "No Content"
+// @Failure 404 {string} string "Not Found"
+// @Router /credentials/{name} [delete]
+func deleteCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	if !credentials.remove(mux.Vars(r)["name"]) {
+		http.Error(w, errCredentialNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -49,6 +49,516 @@ const docTemplate = `{
                             "type": "string"
                         }
                     },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/credentials": {
+            "get": {
+                "description": "Lists stored registry credentials without their secrets",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "List registry credentials",
+                "responses": {
+                    "200": {
+                        "description": "Credentials",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.Credential"
+                            }
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "description": "Stores registry auth under a name that machine configs can refer to with registry_auth.credential. Secrets are never returned by the API.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Store a registry credential",
+                "parameters": [
+                    {
+                        "description": "Credential",
+                        "name": "credential",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.Credential"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Stored credential without secrets",
+                        "schema": {
+                            "$ref": "#/definitions/main.Credential"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/credentials/{name}": {
+            "delete": {
+                "description": "Removes a stored registry credential",
+                "summary": "Delete a registry credential",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Credential name",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/exec/{machine_id}": {
+            "post": {
+                "description": "Executes a command in a running VM",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Execute a command in a VM",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Machine ID",
+                        "name": "machine_id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Command to execute",
+                        "name": "execCmd",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.ExecCommand"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Command Output",
+                        "schema": {
+                            "$ref": "#/definitions/main.ExecResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/images": {
+            "get": {
+                "description": "Lists the images in the local cache",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "List images",
+                "responses": {
+                    "200": {
+                        "description": "Images",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/rootfs.Image"
+                            }
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/images/pull": {
+            "post": {
+                "description": "Pulls an image into the local cache and builds its base root filesystem, so machines created from it later start without pulling. Tags are always resolved with the registry. Images pulled with their own registry_auth are only listed by digest.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Pull an image",
+                "parameters": [
+                    {
+                        "description": "Image",
+                        "name": "image",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.PullImageRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Pulled image",
+                        "schema": {
+                            "$ref": "#/definitions/rootfs.Image"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/images/{ref}": {
+            "get": {
+                "description": "Returns a cached image with its layers, config and the platforms the reference is cached for. ref is a manifest digest or an image reference.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Inspect an image",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Image reference or digest",
+                        "name": "ref",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Platform of the image, defaults to the host's",
+                        "name": "platform",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Image",
+                        "schema": {
+                            "$ref": "#/definitions/rootfs.Image"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "description": "Removes an image, its references and the layers no other image uses from the local cache. Existing machines are not affected.",
+                "summary": "Delete an image",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Image reference or digest",
+                        "name": "ref",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Platform of the image, defaults to the host's",
+                        "name": "platform",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/machines": {
+            "get": {
+                "description": "Lists the machines known to the server",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "List machines",
+                "responses": {
+                    "200": {
+                        "description": "Machines",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.Machine"
+                            }
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/machines/{machine_id}": {
+            "get": {
+                "description": "Retrieves the server's record of a machine, including its interfaces and active firewall rules",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get a machine",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Machine ID",
+                        "name": "machine_id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Machine",
+                        "schema": {
+                            "$ref": "#/definitions/main.Machine"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "description": "Stops the machine and removes its network, firewall rules and files",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Destroy a machine",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Machine ID",
+                        "name": "machine_id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Destroyed machine",
+                        "schema": {
+                            "$ref": "#/definitions/main.CreateResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/machines/{machine_id}/pull": {
+            "get": {
+                "description": "Streams the progress of pulling the machine's image as newline-delimited JSON, one object per update, until the image is pulled. The stream is empty if the image was already cached.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Stream image pull progress",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Machine ID",
+                        "name": "machine_id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Progress updates",
+                        "schema": {
+                            "$ref": "#/definitions/rootfs.Progress"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/machines/{machine_id}/rate_limits": {
+            "put": {
+                "description": "Updates the disk and network rate limits of a running machine. Limits left out of the request are unchanged, a limit with zero size and refill_time removes it.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Update rate limits",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Machine ID",
+                        "name": "machine_id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Rate limits",
+                        "name": "rateLimits",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/firecracker.RateLimits"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Machine",
+                        "schema": {
+                            "$ref": "#/definitions/main.Machine"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
                     "500": {
                         "description": "Internal Server Error",
                         "schema": {
@@ -58,39 +568,129 @@ const docTemplate = `{
                 }
             }
         },
-        "/exec/{machine_id}": {
+        "/networks": {
+            "get": {
+                "description": "Lists the networks machines can be attached to",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "List networks",
+                "responses": {
+                    "200": {
+                        "description": "Networks",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/network.Network"
+                            }
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            },
             "post": {
-                "description": "Executes a command in a running VM",
+                "description": "Creates a named private network with its own bridge and subnet, and optionally an IPv6 prefix for dual-stack machines. Machines on different networks cannot reach each other.",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Execute a command in a VM",
+                "summary": "Create a network",
                 "parameters": [
                     {
-                        "type": "string",
-                        "description": "Machine ID",
-                        "name": "machine_id",
-                        "in": "path",
-                        "required": true
+                        "description": "Network name and subnet",
+                        "name": "network",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.CreateNetworkRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Created network",
+                        "schema": {
+                            "$ref": "#/definitions/network.Network"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/routes": {
+            "get": {
+                "description": "Lists the routes of the ingress proxy",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "List ingress routes",
+                "responses": {
+                    "200": {
+                        "description": "Routes",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/proxy.Route"
+                            }
+                        }
                     },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "description": "Routes HTTP requests arriving at the ingress proxy by Host header and/or path prefix to a port on a machine. Routes are removed when the machine is destroyed.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Create an ingress route",
+                "parameters": [
                     {
-                        "description": "Command to execute",
-                        "name": "execCmd",
+                        "description": "Route",
+                        "name": "route",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/main.ExecCommand"
+                            "$ref": "#/definitions/main.CreateRouteRequest"
                         }
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": "Command Output",
+                        "description": "Created route",
                         "schema": {
-                            "$ref": "#/definitions/main.ExecResponse"
+                            "$ref": "#/definitions/proxy.Route"
                         }
                     },
                     "400": {
@@ -99,6 +699,18 @@ const docTemplate = `{
                             "type": "string"
                         }
                     },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
                     "500": {
                         "description": "Internal Server Error",
                         "schema": {
@@ -108,6 +720,32 @@ const docTemplate = `{
                 }
             }
         },
+        "/routes/{route_id}": {
+            "delete": {
+                "description": "Removes a route from the ingress proxy",
+                "summary": "Delete an ingress route",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Route ID",
+                        "name": "route_id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
         "/status/{machine_id}": {
             "get": {
                 "description": "Retrieves the status of a running VM",
@@ -192,6 +830,56 @@ const docTemplate = `{
         }
     },
     "definitions": {
+        "firecracker.RateLimiter": {
+            "type": "object",
+            "properties": {
+                "bandwidth": {
+                    "$ref": "#/definitions/firecracker.TokenBucket"
+                },
+                "ops": {
+                    "$ref": "#/definitions/firecracker.TokenBucket"
+                }
+            }
+        },
+        "firecracker.RateLimits": {
+            "type": "object",
+            "properties": {
+                "disk": {
+                    "$ref": "#/definitions/firecracker.RateLimiter"
+                },
+                "net_rx": {
+                    "$ref": "#/definitions/firecracker.RateLimiter"
+                },
+                "net_tx": {
+                    "$ref": "#/definitions/firecracker.RateLimiter"
+                }
+            }
+        },
+        "firecracker.TokenBucket": {
+            "type": "object",
+            "properties": {
+                "one_time_burst": {
+                    "type": "integer"
+                },
+                "refill_time": {
+                    "type": "integer"
+                },
+                "size": {
+                    "type": "integer"
+                }
+            }
+        },
+        "main.AutoStop": {
+            "type": "object",
+            "properties": {
+                "idle_minutes": {
+                    "type": "integer"
+                },
+                "mode": {
+                    "type": "string"
+                }
+            }
+        },
         "main.CPU": {
             "type": "object",
             "properties": {
@@ -227,6 +915,20 @@ const docTemplate = `{
                 }
             }
         },
+        "main.CreateNetworkRequest": {
+            "type": "object",
+            "properties": {
+                "name": {
+                    "type": "string"
+                },
+                "subnet": {
+                    "type": "string"
+                },
+                "subnet6": {
+                    "type": "string"
+                }
+            }
+        },
         "main.CreateResponse": {
             "type": "object",
             "properties": {
@@ -238,6 +940,44 @@ const docTemplate = `{
                 }
             }
         },
+        "main.CreateRouteRequest": {
+            "type": "object",
+            "properties": {
+                "host": {
+                    "type": "string"
+                },
+                "machine_id": {
+                    "type": "string"
+                },
+                "path_prefix": {
+                    "type": "string"
+                },
+                "port": {
+                    "type": "integer"
+                }
+            }
+        },
+        "main.Credential": {
+            "type": "object",
+            "properties": {
+                "name": {
+                    "type": "string"
+                },
+                "password": {
+                    "type": "string"
+                },
+                "registry": {
+                    "description": "Registry restricts the credential to images on one registry, such\nas ghcr.io or docker.io. It is stored normalized, docker.io becomes\nindex.docker.io.",
+                    "type": "string"
+                },
+                "token": {
+                    "type": "string"
+                },
+                "username": {
+                    "type": "string"
+                }
+            }
+        },
         "main.DiskStat": {
             "type": "object",
             "properties": {
@@ -298,14 +1038,99 @@ const docTemplate = `{
                 }
             }
         },
-        "main.FileFD": {
+        "main.FileFD": {
+            "type": "object",
+            "properties": {
+                "allocated": {
+                    "type": "integer"
+                },
+                "maximum": {
+                    "type": "integer"
+                }
+            }
+        },
+        "main.Machine": {
+            "type": "object",
+            "properties": {
+                "auto_stop": {
+                    "$ref": "#/definitions/main.AutoStop"
+                },
+                "firewall_rules": {
+                    "description": "FirewallRules are the policy rules currently installed on the host.",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "id": {
+                    "type": "string"
+                },
+                "image": {
+                    "type": "string"
+                },
+                "interfaces": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.MachineInterface"
+                    }
+                },
+                "last_activity": {
+                    "description": "LastActivity is when the machine last served a proxied request or an\nexec call.",
+                    "type": "string"
+                },
+                "metadata": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "name": {
+                    "type": "string"
+                },
+                "network_policy": {
+                    "$ref": "#/definitions/network.Policy"
+                },
+                "pull": {
+                    "description": "Pull is the progress of pulling the machine's image. It is not set\nfor images that were already cached.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/rootfs.Progress"
+                        }
+                    ]
+                },
+                "rate_limits": {
+                    "$ref": "#/definitions/firecracker.RateLimits"
+                },
+                "rootfs": {
+                    "description": "Rootfs is the disk usage of the machine's rootfs.ext4.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/rootfs.DiskUsage"
+                        }
+                    ]
+                },
+                "state": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.MachineInterface": {
             "type": "object",
             "properties": {
-                "allocated": {
-                    "type": "integer"
+                "ip": {
+                    "type": "string"
                 },
-                "maximum": {
-                    "type": "integer"
+                "ip6": {
+                    "type": "string"
+                },
+                "mac": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "network": {
+                    "type": "string"
                 }
             }
         },
@@ -421,6 +1246,37 @@ const docTemplate = `{
                 }
             }
         },
+        "main.PullImageRequest": {
+            "type": "object",
+            "properties": {
+                "image": {
+                    "type": "string"
+                },
+                "platform": {
+                    "type": "string"
+                },
+                "registry_auth": {
+                    "$ref": "#/definitions/main.RegistryAuth"
+                }
+            }
+        },
+        "main.RegistryAuth": {
+            "type": "object",
+            "properties": {
+                "credential": {
+                    "type": "string"
+                },
+                "password": {
+                    "type": "string"
+                },
+                "token": {
+                    "type": "string"
+                },
+                "username": {
+                    "type": "string"
+                }
+            }
+        },
         "main.SysInfo": {
             "type": "object",
             "properties": {
@@ -465,6 +1321,47 @@ const docTemplate = `{
                         "auto_destroy": {
                             "type": "boolean"
                         },
+                        "auto_stop": {
+                            "$ref": "#/definitions/main.AutoStop"
+                        },
+                        "dns": {
+                            "type": "object",
+                            "properties": {
+                                "nameservers": {
+                                    "type": "array",
+                                    "items": {
+                                        "type": "string"
+                                    }
+                                },
+                                "search": {
+                                    "type": "array",
+                                    "items": {
+                                        "type": "string"
+                                    }
+                                }
+                            }
+                        },
+                        "env": {
+                            "description": "Env is added to the image's environment, replacing variables\nof the same name.",
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        },
+                        "extra_hosts": {
+                            "type": "array",
+                            "items": {
+                                "type": "object",
+                                "properties": {
+                                    "hostname": {
+                                        "type": "string"
+                                    },
+                                    "ip": {
+                                        "type": "string"
+                                    }
+                                }
+                            }
+                        },
                         "files": {
                             "type": "array",
                             "items": {
@@ -487,22 +1384,94 @@ const docTemplate = `{
                                 },
                                 "memory_mb": {
                                     "type": "integer"
+                                },
+                                "rate_limits": {
+                                    "$ref": "#/definitions/firecracker.RateLimits"
+                                },
+                                "rootfs_size_mb": {
+                                    "description": "RootfsSizeMB is extra space added to the root filesystem,\nwhich is sized to the image with rootfsHeadroomMB of free\nspace.",
+                                    "type": "integer"
                                 }
                             }
                         },
+                        "hostname": {
+                            "type": "string"
+                        },
                         "image": {
                             "type": "string"
                         },
                         "init": {
+                            "description": "Init overrides what the image runs, like the docker run flags:\nentrypoint replaces the image's entrypoint and drops its cmd,\ncmd replaces the arguments and exec replaces both.",
                             "type": "object",
                             "properties": {
+                                "cmd": {
+                                    "type": "array",
+                                    "items": {
+                                        "type": "string"
+                                    }
+                                },
+                                "entrypoint": {
+                                    "type": "array",
+                                    "items": {
+                                        "type": "string"
+                                    }
+                                },
                                 "exec": {
                                     "type": "array",
                                     "items": {
                                         "type": "string"
                                     }
+                                },
+                                "user": {
+                                    "type": "string"
+                                },
+                                "working_dir": {
+                                    "type": "string"
+                                }
+                            }
+                        },
+                        "interfaces": {
+                            "type": "array",
+                            "items": {
+                                "type": "object",
+                                "properties": {
+                                    "ip": {
+                                        "type": "string"
+                                    },
+                                    "mac": {
+                                        "type": "string"
+                                    },
+                                    "network": {
+                                        "type": "string"
+                                    }
                                 }
                             }
+                        },
+                        "metadata": {
+                            "description": "Metadata is free-form; the ingress.host, ingress.path_prefix and\ningress.port keys route ingress proxy traffic to the machine.",
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        },
+                        "name": {
+                            "type": "string"
+                        },
+                        "network": {
+                            "type": "string"
+                        },
+                        "network_policy": {
+                            "$ref": "#/definitions/network.Policy"
+                        },
+                        "platform": {
+                            "type": "string"
+                        },
+                        "pull": {
+                            "description": "Pull is \"missing\" (the default) to use the digest a tag resolved\nto before, or \"always\" to resolve the tag with the registry.",
+                            "type": "string"
+                        },
+                        "registry_auth": {
+                            "$ref": "#/definitions/main.RegistryAuth"
                         }
                     }
                 }
@@ -515,6 +1484,201 @@ const docTemplate = `{
                     "type": "boolean"
                 }
             }
+        },
+        "network.Network": {
+            "type": "object",
+            "properties": {
+                "bridge": {
+                    "type": "string"
+                },
+                "gateway": {
+                    "type": "string"
+                },
+                "gateway6": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "subnet": {
+                    "type": "string"
+                },
+                "subnet6": {
+                    "type": "string"
+                }
+            }
+        },
+        "network.Policy": {
+            "type": "object",
+            "properties": {
+                "egress": {
+                    "$ref": "#/definitions/network.PolicyRules"
+                },
+                "ingress": {
+                    "$ref": "#/definitions/network.PolicyRules"
+                }
+            }
+        },
+        "network.PolicyRule": {
+            "type": "object",
+            "properties": {
+                "cidr": {
+                    "type": "string"
+                },
+                "ports": {
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                },
+                "protocol": {
+                    "type": "string"
+                }
+            }
+        },
+        "network.PolicyRules": {
+            "type": "object",
+            "properties": {
+                "allow": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/network.PolicyRule"
+                    }
+                },
+                "deny": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/network.PolicyRule"
+                    }
+                }
+            }
+        },
+        "proxy.Route": {
+            "type": "object",
+            "properties": {
+                "host": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "machine_id": {
+                    "type": "string"
+                },
+                "path_prefix": {
+                    "type": "string"
+                },
+                "port": {
+                    "type": "integer"
+                }
+            }
+        },
+        "rootfs.DiskUsage": {
+            "type": "object",
+            "properties": {
+                "allocated_bytes": {
+                    "type": "integer"
+                },
+                "apparent_bytes": {
+                    "type": "integer"
+                }
+            }
+        },
+        "rootfs.Image": {
+            "type": "object",
+            "properties": {
+                "config": {
+                    "type": "object"
+                },
+                "digest": {
+                    "type": "string"
+                },
+                "layers": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/rootfs.Layer"
+                    }
+                },
+                "platform": {
+                    "type": "string"
+                },
+                "platforms": {
+                    "description": "Platforms lists every platform the inspected reference is cached\nfor. It is only set by Inspect.",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "refs": {
+                    "description": "Refs are the references that resolved to the image when it was\npulled.",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "size": {
+                    "description": "Size is the compressed size of the config and layers, as pulled\nfrom the registry.",
+                    "type": "integer"
+                }
+            }
+        },
+        "rootfs.Layer": {
+            "type": "object",
+            "properties": {
+                "diff_id": {
+                    "type": "string"
+                },
+                "digest": {
+                    "type": "string"
+                },
+                "media_type": {
+                    "type": "string"
+                },
+                "size": {
+                    "type": "integer"
+                }
+            }
+        },
+        "rootfs.LayerProgress": {
+            "type": "object",
+            "properties": {
+                "complete": {
+                    "type": "integer"
+                },
+                "digest": {
+                    "type": "string"
+                },
+                "done": {
+                    "type": "boolean"
+                },
+                "size": {
+                    "type": "integer"
+                }
+            }
+        },
+        "rootfs.Progress": {
+            "type": "object",
+            "properties": {
+                "complete": {
+                    "type": "integer"
+                },
+                "digest": {
+                    "type": "string"
+                },
+                "layers": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/rootfs.LayerProgress"
+                    }
+                },
+                "size": {
+                    "type": "integer"
+                },
+                "updated_at": {
+                    "description": "UpdatedAt is when bytes were last read, to tell a slow pull from\none that is stuck.",
+                    "type": "string"
+                }
+            }
         }
     }
 }`
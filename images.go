@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/sushant12/machine/pkg/rootfs"
+)
+
+// Pull policies of machine configs.
+const (
+	PullMissing = "missing"
+	PullAlways  = "always"
+)
+
+type PullImageRequest struct {
+	Image        string       `json:"image"`
+	Platform     string       `json:"platform"`
+	RegistryAuth RegistryAuth `json:"registry_auth"`
+}
+
+// pullOptions validates the pull settings of a machine config or pull
+// request. Errors for unknown stored credentials wrap errCredentialNotFound.
+func pullOptions(image, platform string, auth RegistryAuth) (rootfs.PullOptions, error) {
+	var opts rootfs.PullOptions
+	if platform != "" {
+		p, err := v1.ParsePlatform(platform)
+		if err != nil {
+			return opts, fmt.Errorf("invalid platform: %w", err)
+		}
+		opts.Platform = p
+	}
+	if err := auth.Validate(); err != nil {
+		return opts, err
+	}
+	authenticator, err := auth.Authenticator(image)
+	if err != nil {
+		return opts, err
+	}
+	opts.Auth = authenticator
+	return opts, nil
+}
+
+// requestPlatform returns the platform query parameter, defaulting to the
+// host's platform.
+func requestPlatform(r *http.Request) (v1.Platform, error) {
+	s := r.URL.Query().Get("platform")
+	if s == "" {
+		return rootfs.HostPlatform(), nil
+	}
+	p, err := v1.ParsePlatform(s)
+	if err != nil {
+		return v1.Platform{}, fmt.Errorf("invalid platform: %w", err)
+	}
+	return *p, nil
+}
+
+// @Summary Pull an image
+// @Description Pulls an image into the local cache and builds its base root filesystem, so machines created from it later start without pulling. Tags are always resolved with the registry. Images pulled with their own registry_auth are only listed by digest.
+// @Accept json
+// @Produce json
+// @Param image body PullImageRequest true "Image"
+// @Success 200 {object} rootfs.Image "Pulled image"
+// @Failure 400 {string} string "Bad Request"
+// @Failure 404 {string} string "Not Found"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /images/pull [post]
+func pullImageHandler(w http.ResponseWriter, r *http.Request) {
+	var req PullImageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logrus.WithError(err).Error("Failed to decode JSON")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Image == "" {
+		http.Error(w, "image is required", http.StatusBadRequest)
+		return
+	}
+	opts, err := pullOptions(req.Image, req.Platform, req.RegistryAuth)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errCredentialNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	// Explicit pulls pick up tags that were moved since they were cached.
+	opts.Refresh = true
+
+	_, digest, err := rootfs.DefaultCache.Ext4(req.Image, opts, createExt4Image)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to pull image %s", req.Image)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	platform := rootfs.HostPlatform()
+	if opts.Platform != nil {
+		platform = *opts.Platform
+	}
+	img, err := rootfs.DefaultCache.Inspect(digest.String(), platform)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to inspect image")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	responseJSON, err := json.Marshal(img)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to marshal response JSON")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+// @Summary List images
+// @Description Lists the images in the local cache
+// @Produce json
+// @Success 200 {array} rootfs.Image "Images"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /images [get]
+func listImagesHandler(w http.ResponseWriter, r *http.Request) {
+	images, err := rootfs.DefaultCache.Images()
+	if err != nil {
+		logrus.WithError(err).Error("Failed to list images")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	responseJSON, err := json.Marshal(images)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to marshal response JSON")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+// @Summary Inspect an image
+// @Description Returns a cached image with its layers, config and the platforms the reference is cached for. ref is a manifest digest or an image reference.
+// @Produce json
+// @Param ref path string true "Image reference or digest"
+// @Param platform query string false "Platform of the image, defaults to the host's"
+// @Success 200 {object} rootfs.Image "Image"
+// @Failure 400 {string} string "Bad Request"
+// @Failure 404 {string} string "Not Found"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /images/{ref} [get]
+func getImageHandler(w http.ResponseWriter, r *http.Request) {
+	platform, err := requestPlatform(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	img, err := rootfs.DefaultCache.Inspect(mux.Vars(r)["ref"], platform)
+	if err != nil {
+		http.Error(w, err.Error(), imageErrorStatus(err))
+		return
+	}
+
+	responseJSON, err := json.Marshal(img)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to marshal response JSON")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+// @Summary Delete an image
+// @Description Removes an image, its references and the layers no other image uses from the local cache. Existing machines are not affected.
+// @Param ref path string true "Image reference or digest"
+// @Param platform query string false "Platform of the image, defaults to the host's"
+// @Success 204 "No Content"
+// @Failure 400 {string} string "Bad Request"
+// @Failure 404 {string} string "Not Found"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /images/{ref} [delete]
+func deleteImageHandler(w http.ResponseWriter, r *http.Request) {
+	platform, err := requestPlatform(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	img, err := rootfs.DefaultCache.Remove(mux.Vars(r)["ref"], platform)
+	if err != nil {
+		http.Error(w, err.Error(), imageErrorStatus(err))
+		return
+	}
+	logrus.Infof("Removed image %s", img.Digest)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// imageErrorStatus maps errors of looking up a cached image to a status.
+func imageErrorStatus(err error) int {
+	if errors.Is(err, rootfs.ErrImageNotFound) {
+		return http.StatusNotFound
+	}
+	if name.IsErrBadName(err) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
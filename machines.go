@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/sushant12/machine/pkg/firecracker"
+	"github.com/sushant12/machine/pkg/network"
+	"github.com/sushant12/machine/pkg/rootfs"
+)
+
+const (
+	StateCreated   = "created"
+	StateStarting  = "starting"
+	StateStarted   = "started"
+	StatePaused    = "paused"
+	StateStopped   = "stopped"
+	StateFailed    = "failed"
+	StateDestroyed = "destroyed"
+)
+
+type MachineInterface struct {
+	Name    string `json:"name"`
+	Network string `json:"network"`
+	MAC     string `json:"mac"`
+	IP      string `json:"ip"`
+	IP6     string `json:"ip6,omitempty"`
+}
+
+// Machine is the server's record of a machine it created.
+type Machine struct {
+	ID            string             `json:"id"`
+	Name          string             `json:"name,omitempty"`
+	State         string             `json:"state"`
+	Image         string             `json:"image"`
+	Interfaces    []MachineInterface `json:"interfaces"`
+	NetworkPolicy *network.Policy    `json:"network_policy,omitempty"`
+	// FirewallRules are the policy rules currently installed on the host.
+	FirewallRules []string               `json:"firewall_rules,omitempty"`
+	RateLimits    firecracker.RateLimits `json:"rate_limits"`
+	Metadata      map[string]string      `json:"metadata,omitempty"`
+	AutoStop      *AutoStop              `json:"auto_stop,omitempty"`
+	// LastActivity is when the machine last served a proxied request or an
+	// exec call.
+	LastActivity time.Time `json:"last_activity"`
+	// Rootfs is the disk usage of the machine's rootfs.ext4.
+	Rootfs *rootfs.DiskUsage `json:"rootfs,omitempty"`
+	// Pull is the progress of pulling the machine's image. It is not set
+	// for images that were already cached.
+	Pull *rootfs.Progress `json:"pull,omitempty"`
+
+	// config is the config the machine was created with. Its rate limits
+	// are outdated once RateLimits is updated.
+	config VMConfig
+	cmd    *exec.Cmd
+	exited chan struct{}
+	// pulled is set once the machine's image is pulled or failed to.
+	pulled bool
+	// active counts requests in flight.
+	active int
+	// lifecycle serializes auto-stop and waking the machine.
+	lifecycle *sync.Mutex
+}
+
+type machineStore struct {
+	mu       sync.Mutex
+	machines map[string]*Machine
+}
+
+var machines = &machineStore{machines: map[string]*Machine{}}
+
+func (s *machineStore) add(m *Machine) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.machines[m.ID] = m
+}
+
+func (s *machineStore) get(id string) (Machine, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.machines[id]
+	if !ok {
+		return Machine{}, false
+	}
+	return *m, true
+}
+
+func (s *machineStore) list() []Machine {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]Machine, 0, len(s.machines))
+	for _, m := range s.machines {
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// update runs fn with the machine locked. It returns false if there is no
+// such machine.
+func (s *machineStore) update(id string, fn func(m *Machine)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.machines[id]
+	if !ok {
+		return false
+	}
+	fn(m)
+	return true
+}
+
+func (s *machineStore) remove(id string) (*Machine, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.machines[id]
+	delete(s.machines, id)
+	return m, ok
+}
+
+func machineInterfacesFromLeases(leases []*network.Lease) []MachineInterface {
+	var ifaces []MachineInterface
+	for _, lease := range leases {
+		iface := MachineInterface{
+			Name:    lease.Interface,
+			Network: lease.Network,
+			MAC:     lease.MAC,
+			IP:      lease.IP.String(),
+		}
+		if lease.IP6 != nil {
+			iface.IP6 = lease.IP6.String()
+		}
+		ifaces = append(ifaces, iface)
+	}
+	return ifaces
+}
+
+// watchMachine records the machine as stopped once its Firecracker process
+// exits.
+func watchMachine(machineID string, cmd *exec.Cmd, exited chan struct{}) {
+	err := cmd.Wait()
+	close(exited)
+	machines.update(machineID, func(m *Machine) {
+		if m.cmd != cmd {
+			return
+		}
+		m.State = StateStopped
+		m.cmd = nil
+		m.exited = nil
+	})
+	logrus.WithError(err).Infof("Firecracker process for machine %s exited", machineID)
+}
+
+// stopFirecracker asks the machine's Firecracker process to exit and kills
+// it if it doesn't within the timeout.
+func stopFirecracker(cmd *exec.Cmd, exited chan struct{}, timeout time.Duration) {
+	if cmd == nil || cmd.Process == nil {
+		return
+	}
+	// sudo relays SIGTERM to Firecracker, but SIGKILL can't be relayed so
+	// the child has to be killed directly.
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(timeout):
+		runCommand("sudo", "pkill", "-KILL", "-P", strconv.Itoa(cmd.Process.Pid))
+		cmd.Process.Kill()
+	}
+}
+
+// withDiskUsage fills in the disk usage of the machine's rootfs, if it has
+// been created.
+func withDiskUsage(m Machine) Machine {
+	if usage, err := rootfs.FileDiskUsage(filepath.Join(".", m.ID, "rootfs.ext4")); err == nil {
+		m.Rootfs = &usage
+	}
+	return m
+}
+
+func destroyMachine(m *Machine) error {
+	stopFirecracker(m.cmd, m.exited, 10*time.Second)
+	ingress.RemoveMachine(m.ID)
+
+	var errs []error
+	if err := network.RemovePolicy(m.ID); err != nil {
+		errs = append(errs, fmt.Errorf("removing network policy: %w", err))
+	}
+	if err := networks.Release(m.ID); err != nil {
+		errs = append(errs, fmt.Errorf("releasing network: %w", err))
+	}
+
+	paths := []string{
+		filepath.Join(".", m.ID),
+		filepath.Join("/tmp", fmt.Sprintf("firecracker-%s.socket", m.ID)),
+		filepath.Join("/tmp", fmt.Sprintf("firecracker-vsock-%s.sock", m.ID)),
+		filepath.Join("/tmp", fmt.Sprintf("firecracker-config-%s.json", m.ID)),
+	}
+	for _, path := range paths {
+		if err := os.RemoveAll(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("destroying machine %s: %v", m.ID, errs)
+	}
+	return nil
+}
+
+// @Summary Get a machine
+// @Description Retrieves the server's record of a machine, including its interfaces and active firewall rules
+// @Produce json
+// @Param machine_id path string true "Machine ID"
+// @Success 200 {object} Machine "Machine"
+// @Failure 404 {string} string "Not Found"
+// @Router /machines/{machine_id} [get]
+func getMachineHandler(w http.ResponseWriter, r *http.Request) {
+	machineID := mux.Vars(r)["machine_id"]
+
+	m, ok := machines.get(machineID)
+	if !ok {
+		http.Error(w, "machine not found", http.StatusNotFound)
+		return
+	}
+
+	responseJSON, err := json.Marshal(withDiskUsage(m))
+	if err != nil {
+		logrus.WithError(err).Error("Failed to marshal response JSON")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+// @Summary Stream image pull progress
+// @Description Streams the progress of pulling the machine's image as newline-delimited JSON, one object per update, until the image is pulled. The stream is empty if the image was already cached.
+// @Produce json
+// @Param machine_id path string true "Machine ID"
+// @Success 200 {object} rootfs.Progress "Progress updates"
+// @Failure 404 {string} string "Not Found"
+// @Router /machines/{machine_id}/pull [get]
+func pullProgressHandler(w http.ResponseWriter, r *http.Request) {
+	machineID := mux.Vars(r)["machine_id"]
+
+	if _, ok := machines.get(machineID); !ok {
+		http.Error(w, "machine not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	var sent *rootfs.Progress
+	for {
+		m, ok := machines.get(machineID)
+		if !ok {
+			return
+		}
+		if m.Pull != nil && m.Pull != sent {
+			if err := encoder.Encode(m.Pull); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			sent = m.Pull
+		}
+		if m.pulled || m.State != StateCreated {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// @Summary List machines
+// @Description Lists the machines known to the server
+// @Produce json
+// @Success 200 {array} Machine "Machines"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /machines [get]
+func listMachinesHandler(w http.ResponseWriter, r *http.Request) {
+	list := machines.list()
+	for i := range list {
+		list[i] = withDiskUsage(list[i])
+	}
+
+	responseJSON, err := json.Marshal(list)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to marshal response JSON")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+// @Summary Destroy a machine
+// @Description Stops the machine and removes its network, firewall rules and files
+// @Produce json
+// @Param machine_id path string true "Machine ID"
+// @Success 200 {object} CreateResponse "Destroyed machine"
+// @Failure 404 {string} string "Not Found"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /machines/{machine_id} [delete]
+func destroyMachineHandler(w http.ResponseWriter, r *http.Request) {
+	machineID := mux.Vars(r)["machine_id"]
+
+	m, ok := machines.remove(machineID)
+	if !ok {
+		http.Error(w, "machine not found", http.StatusNotFound)
+		return
+	}
+	m.State = StateDestroyed
+
+	if err := destroyMachine(m); err != nil {
+		logrus.WithError(err).Error("Failed to destroy machine")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	responseJSON, err := json.Marshal(CreateResponse{ID: m.ID, State: m.State})
+	if err != nil {
+		logrus.WithError(err).Error("Failed to marshal response JSON")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+// @Summary Update rate limits
+// @Description Updates the disk and network rate limits of a running machine. Limits left out of the request are unchanged, a limit with zero size and refill_time removes it.
+// @Accept json
+// @Produce json
+// @Param machine_id path string true "Machine ID"
+// @Param rateLimits body firecracker.RateLimits true "Rate limits"
+// @Success 200 {object} Machine "Machine"
+// @Failure 400 {string} string "Bad Request"
+// @Failure 404 {string} string "Not Found"
+// @Failure 409 {string} string "Conflict"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /machines/{machine_id}/rate_limits [put]
+func updateRateLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	machineID := mux.Vars(r)["machine_id"]
+
+	var limits firecracker.RateLimits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		logrus.WithError(err).Error("Failed to decode JSON")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := limits.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m, ok := machines.get(machineID)
+	if !ok {
+		http.Error(w, "machine not found", http.StatusNotFound)
+		return
+	}
+	if m.State != StateStarted {
+		http.Error(w, fmt.Sprintf("machine is %s", m.State), http.StatusConflict)
+		return
+	}
+
+	socketPath := filepath.Join("/tmp", fmt.Sprintf("firecracker-%s.socket", machineID))
+	client := firecracker.NewClient(socketPath)
+	if limits.Disk != nil {
+		if err := client.PatchDriveRateLimiter(r.Context(), "rootfs", limits.Disk); err != nil {
+			logrus.WithError(err).Error("Failed to update disk rate limiter")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if limits.NetRx != nil || limits.NetTx != nil {
+		if err := client.PatchNetworkInterfaceRateLimiters(r.Context(), "eth0", limits.NetRx, limits.NetTx); err != nil {
+			logrus.WithError(err).Error("Failed to update network rate limiters")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	machines.update(machineID, func(m *Machine) {
+		if limits.Disk != nil {
+			m.RateLimits.Disk = limits.Disk
+		}
+		if limits.NetRx != nil {
+			m.RateLimits.NetRx = limits.NetRx
+		}
+		if limits.NetTx != nil {
+			m.RateLimits.NetTx = limits.NetTx
+		}
+	})
+	m, _ = machines.get(machineID)
+
+	responseJSON, err := json.Marshal(m)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to marshal response JSON")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
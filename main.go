@@ -3,22 +3,35 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	_ "github.com/sushant12/machine/docs"
 
 	"github.com/firecracker-microvm/firecracker-go-sdk/vsock"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/gorilla/mux"
 	gonanoid "github.com/matoous/go-nanoid/v2"
 	"github.com/sirupsen/logrus"
+	"github.com/sushant12/machine/pkg/firecracker"
+	"github.com/sushant12/machine/pkg/network"
+	"github.com/sushant12/machine/pkg/proxy"
 	"github.com/sushant12/machine/pkg/rootfs"
 	httpSwagger "github.com/swaggo/http-swagger"
 	_ "github.com/swaggo/swag"
@@ -26,19 +39,60 @@ import (
 
 type VMConfig struct {
 	Config struct {
+		// Init overrides what the image runs, like the docker run flags:
+		// entrypoint replaces the image's entrypoint and drops its cmd,
+		// cmd replaces the arguments and exec replaces both.
 		Init struct {
-			Exec []string `json:"exec"`
+			Exec       []string `json:"exec"`
+			Entrypoint []string `json:"entrypoint"`
+			Cmd        []string `json:"cmd"`
+			User       string   `json:"user"`
+			WorkingDir string   `json:"working_dir"`
 		} `json:"init"`
+		Name        string `json:"name"`
 		AutoDestroy bool   `json:"auto_destroy"`
 		Image       string `json:"image"`
-		Files       []struct {
+		Platform    string `json:"platform"`
+		// Pull is "missing" (the default) to use the digest a tag resolved
+		// to before, or "always" to resolve the tag with the registry.
+		Pull    string `json:"pull"`
+		Network string `json:"network"`
+		// Env is added to the image's environment, replacing variables
+		// of the same name.
+		Env   map[string]string `json:"env"`
+		Files []struct {
 			GuestPath string `json:"guest_path"`
 			RawValue  string `json:"raw_value"`
 		} `json:"files"`
 		Guest struct {
-			CPUs     int    `json:"cpus"`
-			MemoryMB int    `json:"memory_mb"`
+			CPUs       int                    `json:"cpus"`
+			MemoryMB   int                    `json:"memory_mb"`
+			RateLimits firecracker.RateLimits `json:"rate_limits"`
+			// RootfsSizeMB is extra space added to the root filesystem,
+			// which is sized to the image with rootfsHeadroomMB of free
+			// space.
+			RootfsSizeMB int `json:"rootfs_size_mb"`
 		} `json:"guest"`
+		Hostname string `json:"hostname"`
+		DNS      struct {
+			Nameservers []string `json:"nameservers"`
+			Search      []string `json:"search"`
+		} `json:"dns"`
+		ExtraHosts []struct {
+			Hostname string `json:"hostname"`
+			IP       string `json:"ip"`
+		} `json:"extra_hosts"`
+		Interfaces []struct {
+			Network string `json:"network"`
+			MAC     string `json:"mac"`
+			IP      string `json:"ip"`
+		} `json:"interfaces"`
+		NetworkPolicy network.Policy `json:"network_policy"`
+		RegistryAuth  RegistryAuth   `json:"registry_auth"`
+		// Metadata is free-form; the ingress.host, ingress.path_prefix and
+		// ingress.port keys route ingress proxy traffic to the machine.
+		Metadata map[string]string `json:"metadata"`
+		AutoStop AutoStop          `json:"auto_stop"`
 	} `json:"config"`
 }
 
@@ -141,8 +195,22 @@ type CreateResponse struct {
 	State string `json:"state"`
 }
 
+type CreateNetworkRequest struct {
+	Name    string `json:"name"`
+	Subnet  string `json:"subnet"`
+	Subnet6 string `json:"subnet6,omitempty"`
+}
+
 var vsockPath string
 
+var hostnamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*$`)
+
+var networks = network.NewManager()
+
+// rootfsHeadroomMB is the free space left in base images, which are sized
+// from the image's content.
+var rootfsHeadroomMB = rootfs.DefaultHeadroomMB
+
 func runCommand(name string, args ...string) error {
 	cmd := exec.Command(name, args...)
 	var stdout, stderr bytes.Buffer
@@ -160,20 +228,35 @@ func generateNanoID() (string, error) {
 	return gonanoid.Generate("0123456789", 7)
 }
 
-func generateMACAddress() string {
-	// Use 02 as the first octet to ensure it's a locally administered address
-	id, _ := generateNanoID()
-	return fmt.Sprintf("02:00:%02x:%02x:%02x:%02x", 
-		id[0]&0xFF, id[1]&0xFF, id[2]&0xFF, id[3]&0xFF)
-}
+func createConfigFile(vmConfig VMConfig, leases []*network.Lease, rootfsPath, vsockPath, configFilePath string) error {
+	rateLimits := vmConfig.Config.Guest.RateLimits
 
-func getTapDeviceName(machineID string) string {
-	return fmt.Sprintf("tap%s", machineID)
-}
+	networkInterfaces := []map[string]interface{}{}
+	for i, lease := range leases {
+		iface := map[string]interface{}{
+			"iface_id":      lease.Interface,
+			"guest_mac":     lease.MAC,
+			"host_dev_name": lease.TapDevice,
+		}
+		if i == 0 && rateLimits.NetRx != nil {
+			iface["rx_rate_limiter"] = rateLimits.NetRx
+		}
+		if i == 0 && rateLimits.NetTx != nil {
+			iface["tx_rate_limiter"] = rateLimits.NetTx
+		}
+		networkInterfaces = append(networkInterfaces, iface)
+	}
+
+	rootfsDrive := map[string]interface{}{
+		"drive_id":       "rootfs",
+		"is_root_device": false,
+		"is_read_only":   false,
+		"path_on_host":   "/home/sush/Documents/machine/" + rootfsPath+"/rootfs.ext4",
+	}
+	if rateLimits.Disk != nil {
+		rootfsDrive["rate_limiter"] = rateLimits.Disk
+	}
 
-func createConfigFile(vmConfig VMConfig, rootfsPath, vsockPath, configFilePath string) error {
-	machineID := filepath.Base(rootfsPath)
-	
 	config := map[string]interface{}{
 		"boot-source": map[string]interface{}{
 			"kernel_image_path": "./bin/vmlinux",
@@ -187,12 +270,7 @@ func createConfigFile(vmConfig VMConfig, rootfsPath, vsockPath, configFilePath s
 				"is_read_only":   false,
 				"path_on_host":   "/home/sush/Documents/machine/"+ rootfsPath + "/tmpinit", 
 			},
-			{
-				"drive_id":       "rootfs",
-				"is_root_device": false,
-				"is_read_only":   false,
-				"path_on_host":   "/home/sush/Documents/machine/" + rootfsPath+"/rootfs.ext4",
-			},
+			rootfsDrive,
 		},
 		"machine-config": map[string]interface{}{
 			"vcpu_count":        vmConfig.Config.Guest.CPUs,
@@ -201,13 +279,7 @@ func createConfigFile(vmConfig VMConfig, rootfsPath, vsockPath, configFilePath s
 			"track_dirty_pages": false,
 			"huge_pages":        "None",
 		},
-		"network-interfaces": []map[string]interface{}{
-			{
-				"iface_id":      "eth0",
-				"guest_mac":     generateMACAddress(),
-				"host_dev_name": getTapDeviceName(machineID),
-			},
-		},
+		"network-interfaces": networkInterfaces,
 		"vsock": map[string]interface{}{
 			"guest_cid": 3,
 			"uds_path":  vsockPath,
@@ -227,45 +299,184 @@ func createConfigFile(vmConfig VMConfig, rootfsPath, vsockPath, configFilePath s
 	return nil
 }
 
-func createRunJSON(vmConfig VMConfig, machineDir string) error {
-	runConfig := map[string]interface{}{
-		"ImageConfig": map[string]interface{}{
-			"Entrypoint": nil,
-			"Cmd":        []string{"/bin/sleep", "inf"},
-			"Env":        []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
-			"WorkingDir": "/",
-			"User":       "nobody",
+func validateGuestNetworkConfig(vmConfig VMConfig) error {
+	if h := vmConfig.Config.Hostname; h != "" && (len(h) > 253 || !hostnamePattern.MatchString(h)) {
+		return fmt.Errorf("invalid hostname %q", h)
+	}
+	for _, ns := range vmConfig.Config.DNS.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("invalid nameserver %q", ns)
+		}
+	}
+	for _, domain := range vmConfig.Config.DNS.Search {
+		if !hostnamePattern.MatchString(domain) {
+			return fmt.Errorf("invalid search domain %q", domain)
+		}
+	}
+	for _, host := range vmConfig.Config.ExtraHosts {
+		if !hostnamePattern.MatchString(host.Hostname) {
+			return fmt.Errorf("invalid extra host name %q", host.Hostname)
+		}
+		if net.ParseIP(host.IP) == nil {
+			return fmt.Errorf("invalid IP %q for extra host %s", host.IP, host.Hostname)
+		}
+	}
+	return nil
+}
+
+// machineInterfaces returns the interfaces to allocate for the machine,
+// falling back to a single interface on the configured network.
+func machineInterfaces(vmConfig VMConfig) ([]network.Interface, error) {
+	if len(vmConfig.Config.Interfaces) == 0 {
+		return []network.Interface{{Network: vmConfig.Config.Network}}, nil
+	}
+	if vmConfig.Config.Network != "" {
+		return nil, fmt.Errorf("network and interfaces are mutually exclusive")
+	}
+
+	var ifaces []network.Interface
+	for _, iface := range vmConfig.Config.Interfaces {
+		ifaces = append(ifaces, network.Interface{Network: iface.Network, MAC: iface.MAC, IP: iface.IP})
+	}
+	return ifaces, nil
+}
+
+func guestHostname(vmConfig VMConfig, lease *network.Lease) string {
+	if vmConfig.Config.Hostname != "" {
+		return vmConfig.Config.Hostname
+	}
+	if lease.Name != "" {
+		return lease.Name
+	}
+	return lease.MachineID
+}
+
+// defaultPath is set for images that don't set PATH themselves.
+const defaultPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// guestImageConfig returns the ImageConfig of run.json: the image's config
+// with the machine's init and env overrides applied.
+func guestImageConfig(image *v1.ConfigFile, vmConfig VMConfig) (map[string]interface{}, error) {
+	overrides := vmConfig.Config.Init
+	entrypoint, cmd := image.Config.Entrypoint, image.Config.Cmd
+	if overrides.Entrypoint != nil {
+		entrypoint, cmd = overrides.Entrypoint, nil
+	}
+	if overrides.Cmd != nil {
+		cmd = overrides.Cmd
+	}
+	if overrides.Exec != nil {
+		entrypoint, cmd = nil, overrides.Exec
+	}
+	if len(entrypoint) == 0 && len(cmd) == 0 {
+		return nil, fmt.Errorf("the image has no entrypoint or cmd and config.init sets none")
+	}
+
+	env := append([]string(nil), image.Config.Env...)
+	if !slices.ContainsFunc(env, func(e string) bool { return strings.HasPrefix(e, "PATH=") }) {
+		env = append([]string{defaultPath}, env...)
+	}
+	names := make([]string, 0, len(vmConfig.Config.Env))
+	for name := range vmConfig.Config.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = slices.DeleteFunc(env, func(e string) bool { return strings.HasPrefix(e, name+"=") })
+		env = append(env, name+"="+vmConfig.Config.Env[name])
+	}
+
+	workingDir := cmp.Or(overrides.WorkingDir, image.Config.WorkingDir, "/")
+	user := cmp.Or(overrides.User, image.Config.User, "root")
+
+	return map[string]interface{}{
+		"Entrypoint": entrypoint,
+		"Cmd":        cmd,
+		"Env":        env,
+		"WorkingDir": workingDir,
+		"User":       user,
+	}, nil
+}
+
+func createRunJSON(vmConfig VMConfig, image *v1.ConfigFile, machineDir string, leases []*network.Lease) error {
+	imageConfig, err := guestImageConfig(image, vmConfig)
+	if err != nil {
+		return err
+	}
+
+	// The first interface is the machine's primary one, its hostname and
+	// nameserver are on that network.
+	lease := leases[0]
+	hostname := guestHostname(vmConfig, lease)
+
+	// The network's DNS server on the gateway resolves other machines and
+	// forwards everything else upstream, unless the machine brings its own.
+	nameservers := []string{lease.Gateway.String()}
+	if len(vmConfig.Config.DNS.Nameservers) > 0 {
+		nameservers = vmConfig.Config.DNS.Nameservers
+	}
+
+	etcHosts := []map[string]interface{}{
+		{
+			"Host": "localhost",
+			"IP":   "127.0.0.1",
+			"Desc": "Local loopback",
 		},
+		{
+			"Host": hostname,
+			"IP":   lease.IP.String(),
+			"Desc": "Container hostname",
+		},
+	}
+	if lease.IP6 != nil {
+		etcHosts = append(etcHosts, map[string]interface{}{
+			"Host": hostname,
+			"IP":   lease.IP6.String(),
+			"Desc": "Container hostname",
+		})
+	}
+
+	ipConfigs := []map[string]interface{}{}
+	for _, lease := range leases {
+		ipConfigs = append(ipConfigs, map[string]interface{}{
+			"Interface": lease.Interface,
+			"Gateway":   fmt.Sprintf("%s/%d", lease.Gateway, lease.Mask),
+			"IP":        fmt.Sprintf("%s/%d", lease.IP, lease.Mask),
+			"Mask":      lease.Mask,
+		})
+		if lease.IP6 != nil {
+			ipConfigs = append(ipConfigs, map[string]interface{}{
+				"Interface": lease.Interface,
+				"Gateway":   fmt.Sprintf("%s/%d", lease.Gateway6, lease.Mask6),
+				"IP":        fmt.Sprintf("%s/%d", lease.IP6, lease.Mask6),
+				"Mask":      lease.Mask6,
+			})
+		}
+	}
+	for _, host := range vmConfig.Config.ExtraHosts {
+		etcHosts = append(etcHosts, map[string]interface{}{
+			"Host": host.Hostname,
+			"IP":   host.IP,
+			"Desc": "Extra host",
+		})
+	}
+
+	runConfig := map[string]interface{}{
+		"ImageConfig":  imageConfig,
 		"ExecOverride": nil,
 		"ExtraEnv":     nil,
 		"UserOverride": nil,
 		"CmdOverride":  nil,
-		"IPConfigs": []map[string]interface{}{
-			{
-				"Gateway": "172.17.0.1/24",
-				"IP":      "172.17.0.2/24",
-				"Mask":    24,
-			},
-		},
+		"IPConfigs": ipConfigs,
 		"Tty":      true,
-		"Hostname": "container-1",
+		"Hostname": hostname,
 		"Mounts":   nil,
 		"RootDevice": nil,
 		"EtcResolv": map[string]interface{}{
-			"Nameservers": []string{"8.8.8.8", "8.8.4.4"},
-		},
-		"EtcHosts": []map[string]interface{}{
-			{
-				"Host": "localhost",
-				"IP":   "127.0.0.1",
-				"Desc": "Local loopback",
-			},
-			{
-				"Host": "container-1",
-				"IP":   "172.17.0.2",
-				"Desc": "Container hostname",
-			},
+			"Nameservers": nameservers,
+			"Search":      vmConfig.Config.DNS.Search,
 		},
+		"EtcHosts": etcHosts,
 		"files": func() []map[string]string {
 			files := []map[string]string{}
 			for _, file := range vmConfig.Config.Files {
@@ -342,11 +553,15 @@ func setupTmpInitDevice(machineDir, binDir, runJSONPath string) error {
 	return nil
 }
 
-func startFirecrackerInstance(vmConfig VMConfig, rootfsPath, socketPath, vsockPath, configFilePath string) error {
-	if err := createConfigFile(vmConfig, rootfsPath, vsockPath, configFilePath); err != nil {
-		return fmt.Errorf("failed to create config file: %w", err)
+func startFirecrackerInstance(vmConfig VMConfig, leases []*network.Lease, rootfsPath, socketPath, vsockPath, configFilePath string) (*exec.Cmd, error) {
+	if err := createConfigFile(vmConfig, leases, rootfsPath, vsockPath, configFilePath); err != nil {
+		return nil, fmt.Errorf("failed to create config file: %w", err)
 	}
+	return launchFirecracker(rootfsPath, socketPath, configFilePath)
+}
 
+// launchFirecracker starts Firecracker with an existing config file.
+func launchFirecracker(rootfsPath, socketPath, configFilePath string) (*exec.Cmd, error) {
 	logrus.Info("Starting Firecracker process...")
 	cmd := exec.Command("sudo", "./bin/firecracker", "--api-sock", socketPath, "--config-file", configFilePath, "--log-path", "./"+ rootfsPath+"/firecracker.log", "--level", "Debug", "--show-level", "--show-log-origin")
 	logrus.Infof("Executing command: %s %v", cmd.Path, cmd.Args)
@@ -354,11 +569,11 @@ func startFirecrackerInstance(vmConfig VMConfig, rootfsPath, socketPath, vsockPa
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start firecracker process: %w", err)
+		return nil, fmt.Errorf("failed to start firecracker process: %w", err)
 	}
 	logrus.Info("Firecracker process started.")
 
-	return nil
+	return cmd, nil
 }
 
 func communicateWithVsock(vsockPath string, execCmd ExecCommand) (string, error) {
@@ -474,7 +689,7 @@ func readHttpResponse(reader *bufio.Reader) (string, string, error) {
 }
 
 func createExt4Image(machineDir, outputPath string) error {
-	cmd := exec.Command("./bin/mkext4", "-input", machineDir, "-output", outputPath, "-size", "2048")
+	cmd := exec.Command("./bin/mkext4", "-input", machineDir, "-output", outputPath, "-headroom", strconv.Itoa(rootfsHeadroomMB))
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
@@ -486,6 +701,13 @@ func createExt4Image(machineDir, outputPath string) error {
 	return nil
 }
 
+// bootMachine runs boot, which prepares and launches an accepted machine,
+// in the background. Tests replace it, as they can't pull images, set up
+// networks or launch Firecracker.
+var bootMachine = func(boot func()) {
+	go boot()
+}
+
 // @Summary Start a new Firecracker VM
 // @Description Starts a new Firecracker VM with the provided configuration
 // @Accept json
@@ -493,6 +715,7 @@ func createExt4Image(machineDir, outputPath string) error {
 // @Param vmConfig body VMConfig true "VM Configuration"
 // @Success 200 {object} CreateResponse "VM Creation Response"
 // @Failure 400 {string} string "Bad Request"
+// @Failure 409 {string} string "Conflict"
 // @Failure 500 {string} string "Internal Server Error"
 // @Router /create [post]
 func startVMHandler(w http.ResponseWriter, r *http.Request) {
@@ -508,6 +731,48 @@ func startVMHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := validateGuestNetworkConfig(vmConfig); err != nil {
+		logrus.WithError(err).Error("Invalid machine config")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := vmConfig.Config.NetworkPolicy.Validate(); err != nil {
+		logrus.WithError(err).Error("Invalid network policy")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := vmConfig.Config.Guest.RateLimits.Validate(); err != nil {
+		logrus.WithError(err).Error("Invalid rate limits")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pullOpts, err := pullOptions(vmConfig.Config.Image, vmConfig.Config.Platform, vmConfig.Config.RegistryAuth)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errCredentialNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	switch vmConfig.Config.Pull {
+	case "", PullMissing:
+	case PullAlways:
+		pullOpts.Refresh = true
+	default:
+		http.Error(w, fmt.Sprintf("unknown pull policy %q", vmConfig.Config.Pull), http.StatusBadRequest)
+		return
+	}
+	if vmConfig.Config.Guest.RootfsSizeMB < 0 {
+		http.Error(w, "guest.rootfs_size_mb must not be negative", http.StatusBadRequest)
+		return
+	}
+	if err := vmConfig.Config.AutoStop.Validate(); err != nil {
+		logrus.WithError(err).Error("Invalid auto stop config")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	machineID, err := generateNanoID()
 	if err != nil {
 		logrus.WithError(err).Error("Failed to generate machine ID")
@@ -515,7 +780,52 @@ func startVMHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ifaces, err := machineInterfaces(vmConfig)
+	if err != nil {
+		logrus.WithError(err).Error("Invalid machine config")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	route, err := metadataRoute(machineID, vmConfig.Config.Metadata)
+	if err != nil {
+		logrus.WithError(err).Error("Invalid ingress metadata")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	leases, err := networks.Allocate(machineID, vmConfig.Config.Name, ifaces)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to allocate machine address")
+		status := http.StatusBadRequest
+		if errors.Is(err, network.ErrFull) {
+			status = http.StatusInternalServerError
+		} else if errors.Is(err, network.ErrNameTaken) || errors.Is(err, network.ErrAddressInUse) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
 	machineDir := filepath.Join(".", machineID)
+
+	// Until the machine is handed to bootMachine, failing requests give
+	// back what was set up for it.
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		machines.remove(machineID)
+		ingress.RemoveMachine(machineID)
+		if err := networks.Release(machineID); err != nil {
+			logrus.WithError(err).Error("Failed to release machine network")
+		}
+		if err := os.RemoveAll(machineDir); err != nil {
+			logrus.WithError(err).Error("Failed to remove machine directory")
+		}
+	}()
+
 	if err := os.MkdirAll(machineDir, 0755); err != nil {
 		logrus.WithError(err).Error("Failed to create machine directory")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -540,26 +850,92 @@ func startVMHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go func() {
-		logrus.Info("extracting rootfs...")
-
-		if err := rootfs.ExtractFromImage(vmConfig.Config.Image, machineDir+"/rootfs"); err != nil {
-			logrus.WithError(err).Error("Failed to extract rootfs")
+	machine := &Machine{
+		ID:         machineID,
+		Name:       vmConfig.Config.Name,
+		State:      StateCreated,
+		Image:      vmConfig.Config.Image,
+		Interfaces: machineInterfacesFromLeases(leases),
+		RateLimits: vmConfig.Config.Guest.RateLimits,
+		Metadata:   vmConfig.Config.Metadata,
+		config:     vmConfig,
+		lifecycle:  &sync.Mutex{},
+	}
+	if !vmConfig.Config.NetworkPolicy.Empty() {
+		machine.NetworkPolicy = &vmConfig.Config.NetworkPolicy
+	}
+	if vmConfig.Config.AutoStop.Enabled() {
+		machine.AutoStop = &vmConfig.Config.AutoStop
+	}
+	machines.add(machine)
+
+	// Routes are only added to machines with a record.
+	if route != nil {
+		if _, err := ingress.Add(*route); err != nil {
+			logrus.WithError(err).Error("Failed to add ingress route")
+			status := http.StatusBadRequest
+			if errors.Is(err, proxy.ErrRouteExists) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
 			return
 		}
-		logrus.Info("create ext4...")
+	}
+
+	committed = true
+	bootMachine(func() {
+		started := false
+		defer func() {
+			if started {
+				return
+			}
+			machines.update(machineID, func(m *Machine) {
+				m.State = StateFailed
+				m.FirewallRules = nil
+			})
+			ingress.RemoveMachine(machineID)
+			if err := network.RemovePolicy(machineID); err != nil {
+				logrus.WithError(err).Error("Failed to remove network policy")
+			}
+			if err := networks.Release(machineID); err != nil {
+				logrus.WithError(err).Error("Failed to release machine network")
+			}
+		}()
 
-		if err := createExt4Image(machineDir+"/rootfs", machineDir+"/rootfs.ext4"); err != nil {
+		logrus.Info("preparing rootfs...")
+
+		// The ext4 image is built once per image digest and cloned for
+		// each machine.
+		pullOpts.Progress = func(p rootfs.Progress) {
+			machines.update(machineID, func(m *Machine) {
+				m.Pull = &p
+			})
+		}
+		baseImage, digest, err := rootfs.DefaultCache.Ext4(vmConfig.Config.Image, pullOpts, createExt4Image)
+		machines.update(machineID, func(m *Machine) {
+			m.pulled = true
+		})
+		if err != nil {
 			logrus.WithError(err).Error("Failed to create ext4 image")
 			return
 		}
-
-		rootfsDir := filepath.Join(machineDir, "rootfs")
-		if err := os.RemoveAll(rootfsDir); err != nil {
-			logrus.WithError(err).Error("Failed to clean up rootfs directory")
+		imageConfig, err := rootfs.DefaultCache.ConfigFile(digest)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to read image config")
+			return
+		}
+		if err := rootfs.CloneFile(baseImage, filepath.Join(machineDir, "rootfs.ext4")); err != nil {
+			logrus.WithError(err).Error("Failed to clone ext4 image")
+			return
+		}
+		if extraMB := vmConfig.Config.Guest.RootfsSizeMB; extraMB > 0 {
+			if err := rootfs.GrowExt4(filepath.Join(machineDir, "rootfs.ext4"), extraMB); err != nil {
+				logrus.WithError(err).Error("Failed to resize rootfs")
+				return
+			}
 		}
 
-		if err := createRunJSON(vmConfig, machineDir); err != nil {
+		if err := createRunJSON(vmConfig, imageConfig, machineDir, leases); err != nil {
 			logrus.WithError(err).Error("Failed to create run.json file")
 			return
 		}
@@ -570,18 +946,50 @@ func startVMHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := startFirecrackerInstance(vmConfig, machineDir, socketPath, vsockPath, configFilePath); err != nil {
+		if err := networks.Attach(machineID); err != nil {
+			logrus.WithError(err).Error("Failed to attach machine to network")
+			return
+		}
+
+		rules, err := network.ApplyPolicy(leases, vmConfig.Config.NetworkPolicy)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to apply network policy")
+			return
+		}
+		machines.update(machineID, func(m *Machine) {
+			m.FirewallRules = rules
+		})
+
+		cmd, err := startFirecrackerInstance(vmConfig, leases, machineDir, socketPath, vsockPath, configFilePath)
+		if err != nil {
 			logrus.WithError(err).Error("Failed to start Firecracker instance")
 			return
 		}
+		started = true
+
+		exited := make(chan struct{})
+		go watchMachine(machineID, cmd, exited)
+		registered := machines.update(machineID, func(m *Machine) {
+			m.State = StateStarted
+			m.cmd = cmd
+			m.exited = exited
+			m.LastActivity = time.Now()
+		})
+		if !registered {
+			// The machine was destroyed while it was being created.
+			if err := destroyMachine(&Machine{ID: machineID, cmd: cmd, exited: exited}); err != nil {
+				logrus.WithError(err).Error("Failed to clean up destroyed machine")
+			}
+			return
+		}
 
 		logrus.Infof("VM started with config: %+v", vmConfig)
 		logrus.Infof("vsockPath: %s", vsockPath)
-	}()
+	})
 
 	response := CreateResponse{
 		ID:    machineID,
-		State: "created",
+		State: StateCreated,
 	}
 	responseJSON, err := json.Marshal(response)
 	if err != nil {
@@ -621,6 +1029,17 @@ func execCommandHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := acquireMachine(r.Context(), machineID); err != nil {
+		logrus.WithError(err).Error("Machine is not available")
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, errMachineNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer releaseMachine(machineID)
+
 	response, err := communicateWithVsock(vsockPath, execCmd)
 	if err != nil {
 		logrus.WithError(err).Error("Failed to communicate with vsock")
@@ -726,13 +1145,84 @@ func sysInfo(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(responseJSON)
 }
- 
+
+// @Summary Create a network
+// @Description Creates a named private network with its own bridge and subnet, and optionally an IPv6 prefix for dual-stack machines. Machines on different networks cannot reach each other.
+// @Accept json
+// @Produce json
+// @Param network body CreateNetworkRequest true "Network name and subnet"
+// @Success 200 {object} network.Network "Created network"
+// @Failure 400 {string} string "Bad Request"
+// @Failure 409 {string} string "Conflict"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /networks [post]
+func createNetworkHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreateNetworkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logrus.WithError(err).Error("Failed to decode JSON")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || req.Subnet == "" {
+		http.Error(w, "name and subnet are required", http.StatusBadRequest)
+		return
+	}
+
+	n, err := networks.Create(req.Name, req.Subnet, req.Subnet6)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to create network")
+		status := http.StatusBadRequest
+		if errors.Is(err, network.ErrExists) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	responseJSON, err := json.Marshal(n)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to marshal response JSON")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+// @Summary List networks
+// @Description Lists the networks machines can be attached to
+// @Produce json
+// @Success 200 {array} network.Network "Networks"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /networks [get]
+func listNetworksHandler(w http.ResponseWriter, r *http.Request) {
+	responseJSON, err := json.Marshal(networks.List())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to marshal response JSON")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
 // @title Firecracker VM API
 // @version 1.0
 // @description API for managing and controlling Firecracker VMs
 // @host localhost:8080
 // @BasePath /
 func main() {
+	ingressAddr := flag.String("ingress", "127.0.0.1:8081", "address of the HTTP ingress proxy, empty to disable")
+	flag.IntVar(&rootfsHeadroomMB, "rootfs-headroom", rootfs.DefaultHeadroomMB, "free space in MB to leave in root filesystems built from images")
+	flag.Func("registry-mirror", "mirror for a registry as registry=mirror, e.g. docker.io=mirror.local:5000; repeat to try several mirrors in order", rootfs.DefaultCache.Registries.AddMirror)
+	flag.Func("insecure-registry", "registry to reach over plain HTTP or without TLS verification; can be repeated", func(registry string) error {
+		rootfs.DefaultCache.Registries.Insecure = append(rootfs.DefaultCache.Registries.Insecure, registry)
+		return nil
+	})
+	flag.Parse()
+
 	logrus.SetFormatter(&logrus.JSONFormatter{})
 	logrus.SetLevel(logrus.InfoLevel)
 
@@ -741,6 +1231,23 @@ func main() {
 	r.HandleFunc("/status/{machine_id}", vmStatus).Methods("GET")
 	r.HandleFunc("/sys_info/{machine_id}", sysInfo).Methods("GET")
 	r.HandleFunc("/exec/{machine_id}", execCommandHandler).Methods("POST")
+	r.HandleFunc("/machines", listMachinesHandler).Methods("GET")
+	r.HandleFunc("/machines/{machine_id}", getMachineHandler).Methods("GET")
+	r.HandleFunc("/machines/{machine_id}", destroyMachineHandler).Methods("DELETE")
+	r.HandleFunc("/machines/{machine_id}/rate_limits", updateRateLimitsHandler).Methods("PUT")
+	r.HandleFunc("/machines/{machine_id}/pull", pullProgressHandler).Methods("GET")
+	r.HandleFunc("/networks", createNetworkHandler).Methods("POST")
+	r.HandleFunc("/networks", listNetworksHandler).Methods("GET")
+	r.HandleFunc("/routes", createRouteHandler).Methods("POST")
+	r.HandleFunc("/routes", listRoutesHandler).Methods("GET")
+	r.HandleFunc("/routes/{route_id}", deleteRouteHandler).Methods("DELETE")
+	r.HandleFunc("/credentials", createCredentialHandler).Methods("POST")
+	r.HandleFunc("/credentials", listCredentialsHandler).Methods("GET")
+	r.HandleFunc("/credentials/{name}", deleteCredentialHandler).Methods("DELETE")
+	r.HandleFunc("/images/pull", pullImageHandler).Methods("POST")
+	r.HandleFunc("/images", listImagesHandler).Methods("GET")
+	r.HandleFunc("/images/{ref:.+}", getImageHandler).Methods("GET")
+	r.HandleFunc("/images/{ref:.+}", deleteImageHandler).Methods("DELETE")
 	
 	r.PathPrefix("/swagger/").Handler(httpSwagger.Handler(
 		httpSwagger.URL("/swagger/doc.json"),
@@ -749,6 +1256,17 @@ func main() {
 		httpSwagger.DomID("swagger-ui"),
 	))
 
+	go autoStopIdleMachines(30 * time.Second)
+
+	if *ingressAddr != "" {
+		go func() {
+			logrus.Infof("Ingress proxy is listening on %s...", *ingressAddr)
+			if err := http.ListenAndServe(*ingressAddr, ingress); err != nil {
+				logrus.WithError(err).Fatal("Failed to start ingress proxy")
+			}
+		}()
+	}
+
 	logrus.Info("Server is listening on port 8080...")
 	logrus.Info("Swagger documentation available at http://localhost:8080/swagger/")
 	if err := http.ListenAndServe(":8080", r); err != nil {
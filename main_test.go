@@ -3,56 +3,55 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/gorilla/mux"
+	"github.com/sushant12/machine/pkg/rootfs"
 )
 
 func TestStartVMHandler(t *testing.T) {
-	vmConfig := VMConfig{
-		Config: struct {
-			Init struct {
-				Exec []string `json:"exec"`
-			} `json:"init"`
-			AutoDestroy bool   `json:"auto_destroy"`
-			Image       string `json:"image"`
-			Files       []struct {
-				GuestPath string `json:"guest_path"`
-				RawValue  string `json:"raw_value"`
-			} `json:"files"`
-			Guest struct {
-				CPUKind  string `json:"cpu_kind"`
-				CPUs     int    `json:"cpus"`
-				MemoryMB int    `json:"memory_mb"`
-			} `json:"guest"`
-		}{
-			Init: struct {
-				Exec []string `json:"exec"`
-			}{
-				Exec: []string{"/bin/sleep", "inf"},
-			},
-			AutoDestroy: true,
-			Image:       "alpine:latest",
-			Files: []struct {
-				GuestPath string `json:"guest_path"`
-				RawValue  string `json:"raw_value"`
-			}{
-				{
-					GuestPath: "/main.sh",
-					RawValue:  "example-base64-encoded-value",
-				},
-			},
-			Guest: struct {
-				CPUKind  string `json:"cpu_kind"`
-				CPUs     int    `json:"cpus"`
-				MemoryMB int    `json:"memory_mb"`
-			}{
-				CPUKind:  "shared",
-				CPUs:     2,
-				MemoryMB: 2048,
-			},
-		},
+	var vmConfig VMConfig
+	vmConfig.Config.Init.Exec = []string{"/bin/sleep", "inf"}
+	vmConfig.Config.AutoDestroy = true
+	vmConfig.Config.Image = "alpine:latest"
+	vmConfig.Config.Files = append(vmConfig.Config.Files, struct {
+		GuestPath string `json:"guest_path"`
+		RawValue  string `json:"raw_value"`
+	}{
+		GuestPath: "/main.sh",
+		RawValue:  "example-base64-encoded-value",
+	})
+	vmConfig.Config.Guest.CPUs = 2
+	vmConfig.Config.Guest.MemoryMB = 2048
+
+	// Booting pulls the image, sets up the network and launches
+	// Firecracker, none of which tests can do.
+	booted := make(chan struct{}, 1)
+	defer func(f func(func())) { bootMachine = f }(bootMachine)
+	bootMachine = func(func()) {
+		booted <- struct{}{}
+	}
+
+	// The handler creates the machine directory relative to the working
+	// directory, keep it out of the source tree.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("Failed to change working directory: %v", err)
 	}
+	defer os.Chdir(wd)
 
 	body, err := json.Marshal(vmConfig)
 	if err != nil {
@@ -70,11 +69,264 @@ func TestStartVMHandler(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusOK {
-		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		t.Fatalf("Handler returned wrong status code: got %v want %v: %s", status, http.StatusOK, rr.Body.String())
+	}
+	var response CreateResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if response.State != StateCreated {
+		t.Errorf("Handler returned state %q, want %q", response.State, StateCreated)
+	}
+	defer machines.remove(response.ID)
+
+	select {
+	case <-booted:
+	default:
+		t.Fatal("Machine was not booted")
+	}
+
+	m, ok := machines.get(response.ID)
+	if !ok {
+		t.Fatalf("Machine %s was not recorded", response.ID)
+	}
+	if m.State != StateCreated || m.Image != "alpine:latest" {
+		t.Errorf("Unexpected machine record %+v", m)
+	}
+	if len(m.Interfaces) != 1 || m.Interfaces[0].IP == "" {
+		t.Errorf("Machine has no address: %+v", m.Interfaces)
+	}
+	if _, err := os.Stat(filepath.Join(response.ID, "firecracker.log")); err != nil {
+		t.Errorf("Machine directory was not set up: %v", err)
+	}
+}
+
+func TestRegistryAuthRedacted(t *testing.T) {
+	var vmConfig VMConfig
+	vmConfig.Config.RegistryAuth = RegistryAuth{Username: "ci", Password: "hunter2"}
+
+	if logged := fmt.Sprintf("%+v", vmConfig); strings.Contains(logged, "hunter2") {
+		t.Errorf("password leaked into %s", logged)
+	}
+}
+
+func TestCredentialRegistry(t *testing.T) {
+	for _, registry := range []string{"docker.io/library", "ghcr.io/"} {
+		body := fmt.Sprintf(`{"name":"invalid","registry":%q,"token":"secret"}`, registry)
+		rr := httptest.NewRecorder()
+		createCredentialHandler(rr, httptest.NewRequest(http.MethodPost, "/credentials", strings.NewReader(body)))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("registry %q: got status %d, want %d", registry, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	body := `{"name":"hub","registry":"docker.io","token":"secret"}`
+	createCredentialHandler(rr, httptest.NewRequest(http.MethodPost, "/credentials", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body.String())
+	}
+	defer credentials.remove("hub")
+	if c, _ := credentials.get("hub"); c.Registry != "index.docker.io" {
+		t.Errorf("registry stored as %q, want index.docker.io", c.Registry)
+	}
+
+	auth := RegistryAuth{Credential: "hub"}
+	for _, image := range []string{"alpine", "docker.io/library/alpine:3.20", "index.docker.io/library/alpine"} {
+		if _, err := auth.Authenticator(image); err != nil {
+			t.Errorf("%s: %v", image, err)
+		}
+	}
+	if _, err := auth.Authenticator("ghcr.io/org/app"); err == nil {
+		t.Error("credential for docker.io was used for ghcr.io")
+	}
+}
+
+func TestGuestImageConfig(t *testing.T) {
+	image := &v1.ConfigFile{Config: v1.Config{
+		Entrypoint: []string{"/docker-entrypoint.sh"},
+		Cmd:        []string{"nginx", "-g", "daemon off;"},
+		Env:        []string{"PATH=/usr/sbin:/usr/bin", "NGINX_VERSION=1.27"},
+		WorkingDir: "/srv",
+		User:       "nginx",
+	}}
+
+	tests := []struct {
+		name       string
+		configure  func(*VMConfig)
+		entrypoint []string
+		cmd        []string
+		env        []string
+		workingDir string
+		user       string
+	}{
+		{
+			name:       "image defaults",
+			configure:  func(*VMConfig) {},
+			entrypoint: []string{"/docker-entrypoint.sh"},
+			cmd:        []string{"nginx", "-g", "daemon off;"},
+			env:        []string{"PATH=/usr/sbin:/usr/bin", "NGINX_VERSION=1.27"},
+			workingDir: "/srv",
+			user:       "nginx",
+		},
+		{
+			name: "cmd keeps entrypoint",
+			configure: func(c *VMConfig) {
+				c.Config.Init.Cmd = []string{"nginx-debug"}
+			},
+			entrypoint: []string{"/docker-entrypoint.sh"},
+			cmd:        []string{"nginx-debug"},
+			env:        []string{"PATH=/usr/sbin:/usr/bin", "NGINX_VERSION=1.27"},
+			workingDir: "/srv",
+			user:       "nginx",
+		},
+		{
+			name: "entrypoint drops cmd",
+			configure: func(c *VMConfig) {
+				c.Config.Init.Entrypoint = []string{"/bin/sh"}
+			},
+			entrypoint: []string{"/bin/sh"},
+			env:        []string{"PATH=/usr/sbin:/usr/bin", "NGINX_VERSION=1.27"},
+			workingDir: "/srv",
+			user:       "nginx",
+		},
+		{
+			name: "exec and overrides",
+			configure: func(c *VMConfig) {
+				c.Config.Init.Exec = []string{"/bin/sleep", "inf"}
+				c.Config.Init.Cmd = []string{"ignored"}
+				c.Config.Init.User = "root"
+				c.Config.Init.WorkingDir = "/tmp"
+				c.Config.Env = map[string]string{"NGINX_VERSION": "1.28", "DEBUG": "1"}
+			},
+			cmd:        []string{"/bin/sleep", "inf"},
+			env:        []string{"PATH=/usr/sbin:/usr/bin", "DEBUG=1", "NGINX_VERSION=1.28"},
+			workingDir: "/tmp",
+			user:       "root",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var vmConfig VMConfig
+			tt.configure(&vmConfig)
+			got, err := guestImageConfig(image, vmConfig)
+			if err != nil {
+				t.Fatalf("guestImageConfig failed: %v", err)
+			}
+			want := map[string]interface{}{
+				"Entrypoint": tt.entrypoint,
+				"Cmd":        tt.cmd,
+				"Env":        tt.env,
+				"WorkingDir": tt.workingDir,
+				"User":       tt.user,
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestGuestImageConfigDefaults(t *testing.T) {
+	var vmConfig VMConfig
+	vmConfig.Config.Init.Cmd = []string{"/bin/sh"}
+
+	got, err := guestImageConfig(&v1.ConfigFile{}, vmConfig)
+	if err != nil {
+		t.Fatalf("guestImageConfig failed: %v", err)
+	}
+	if env := got["Env"].([]string); len(env) != 1 || env[0] != defaultPath {
+		t.Errorf("Env = %q, want default PATH", env)
+	}
+	if got["WorkingDir"] != "/" || got["User"] != "root" {
+		t.Errorf("WorkingDir, User = %v, %v", got["WorkingDir"], got["User"])
+	}
+
+	if _, err := guestImageConfig(&v1.ConfigFile{}, VMConfig{}); err == nil {
+		t.Error("expected an error for an image without a command")
+	}
+}
+
+func TestImageHandlers(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("Failed to change working directory: %v", err)
+	}
+	defer os.Chdir(wd)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/images", listImagesHandler).Methods("GET")
+	r.HandleFunc("/images/{ref:.+}", getImageHandler).Methods("GET")
+	r.HandleFunc("/images/{ref:.+}", deleteImageHandler).Methods("DELETE")
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		body   string
+	}{
+		{http.MethodGet, "/images", http.StatusOK, "[]"},
+		{http.MethodGet, "/images/docker.io/library/alpine:latest", http.StatusNotFound, ""},
+		{http.MethodGet, "/images/Alpine:latest", http.StatusBadRequest, ""},
+		{http.MethodDelete, "/images/sha256:" + strings.Repeat("0", 64), http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("%s %s: got status %d, want %d: %s", tt.method, tt.path, rr.Code, tt.status, rr.Body.String())
+		}
+		if tt.body != "" && rr.Body.String() != tt.body {
+			t.Errorf("%s %s: got body %s, want %s", tt.method, tt.path, rr.Body.String(), tt.body)
+		}
+	}
+}
+
+func TestPullProgressHandler(t *testing.T) {
+	machines.add(&Machine{ID: "pulling", State: StateCreated, lifecycle: &sync.Mutex{}})
+	defer machines.remove("pulling")
+
+	go func() {
+		for i := int64(1); i <= 2; i++ {
+			time.Sleep(300 * time.Millisecond)
+			machines.update("pulling", func(m *Machine) {
+				m.Pull = &rootfs.Progress{Size: 2, Complete: i}
+			})
+		}
+		time.Sleep(300 * time.Millisecond)
+		machines.update("pulling", func(m *Machine) {
+			m.pulled = true
+		})
+	}()
+
+	r := mux.NewRouter()
+	r.HandleFunc("/machines/{machine_id}/pull", pullProgressHandler).Methods("GET")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/machines/pulling/pull", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body.String())
+	}
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d updates, want 2: %s", len(lines), rr.Body.String())
+	}
+	var last rootfs.Progress
+	if err := json.Unmarshal([]byte(lines[1]), &last); err != nil {
+		t.Fatalf("decoding update: %v", err)
+	}
+	if last.Complete != 2 {
+		t.Errorf("last update = %+v", last)
 	}
 
-	expected := "VM started with config"
-	if !bytes.Contains(rr.Body.Bytes(), []byte(expected)) {
-		t.Errorf("Handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/machines/unknown/pull", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown machine", rr.Code)
 	}
 }
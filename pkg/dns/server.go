@@ -0,0 +1,294 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// Domain is the zone machines are reachable under, e.g. 1234567.internal.
+	Domain = "internal"
+
+	ttl             = 5
+	upstreamTimeout = 5 * time.Second
+)
+
+var DefaultUpstream = []string{"8.8.8.8:53", "8.8.4.4:53"}
+
+// LookupFunc returns the addresses of the machine with the given ID or
+// name, or nil if there is no such machine.
+type LookupFunc func(host string) []net.IP
+
+// Server answers queries for machines on a single network and forwards
+// everything else to the upstream resolvers.
+type Server struct {
+	Addr     string
+	Lookup   LookupFunc
+	Upstream []string
+
+	mu       sync.Mutex
+	conn     net.PacketConn
+	listener net.Listener
+}
+
+func NewServer(addr string, lookup LookupFunc, upstream []string) *Server {
+	if len(upstream) == 0 {
+		upstream = DefaultUpstream
+	}
+	return &Server{Addr: addr, Lookup: lookup, Upstream: upstream}
+}
+
+// Start listens on Addr over UDP and TCP and serves queries in the
+// background until Close is called.
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conn, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("listening on udp %s: %w", s.Addr, err)
+	}
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("listening on tcp %s: %w", s.Addr, err)
+	}
+	s.conn = conn
+	s.listener = listener
+
+	go s.serveUDP(conn)
+	go s.serveTCP(listener)
+	return nil
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	if s.conn != nil {
+		errs = append(errs, s.conn.Close())
+	}
+	if s.listener != nil {
+		errs = append(errs, s.listener.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logrus.WithError(err).Warn("Failed to read DNS query")
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			resp, err := s.handle(query, "udp")
+			if err != nil {
+				logrus.WithError(err).Warn("Failed to answer DNS query")
+				return
+			}
+			conn.WriteTo(resp, addr)
+		}()
+	}
+}
+
+func (s *Server) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logrus.WithError(err).Warn("Failed to accept DNS connection")
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			for {
+				conn.SetDeadline(time.Now().Add(upstreamTimeout))
+				query, err := readTCPMessage(reader)
+				if err != nil {
+					return
+				}
+				resp, err := s.handle(query, "tcp")
+				if err != nil {
+					logrus.WithError(err).Warn("Failed to answer DNS query")
+					return
+				}
+				if err := writeTCPMessage(conn, resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (s *Server) handle(query []byte, proto string) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		return nil, fmt.Errorf("parsing query: %w", err)
+	}
+	if len(msg.Questions) != 1 {
+		return s.forward(query, proto)
+	}
+
+	q := msg.Questions[0]
+	host, internal := machineHost(q.Name.String())
+	if host == "" {
+		return s.forward(query, proto)
+	}
+	ips := s.Lookup(host)
+	if ips == nil {
+		if !internal {
+			return s.forward(query, proto)
+		}
+		return reply(msg, dnsmessage.RCodeNameError, nil)
+	}
+
+	var answers []dnsmessage.Resource
+	for _, ip := range ips {
+		header := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: ttl}
+		if ip4 := ip.To4(); ip4 != nil {
+			if q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeALL {
+				header.Type = dnsmessage.TypeA
+				answers = append(answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: [4]byte(ip4)}})
+			}
+		} else if q.Type == dnsmessage.TypeAAAA || q.Type == dnsmessage.TypeALL {
+			header.Type = dnsmessage.TypeAAAA
+			answers = append(answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())}})
+		}
+	}
+	return reply(msg, dnsmessage.RCodeSuccess, answers)
+}
+
+// machineHost returns the machine ID or name a query is for. Names in the
+// internal zone are always answered locally, single label names only when
+// they match a machine.
+func machineHost(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if host, ok := strings.CutSuffix(name, "."+Domain); ok {
+		if strings.Contains(host, ".") {
+			return "", false
+		}
+		return host, true
+	}
+	if name != "" && !strings.Contains(name, ".") {
+		return name, false
+	}
+	return "", false
+}
+
+func reply(query dnsmessage.Message, rcode dnsmessage.RCode, answers []dnsmessage.Resource) ([]byte, error) {
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.Header.ID,
+			Response:           true,
+			Authoritative:      true,
+			RecursionDesired:   query.Header.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: query.Questions,
+		Answers:   answers,
+	}
+	return resp.Pack()
+}
+
+func (s *Server) forward(query []byte, proto string) ([]byte, error) {
+	var lastErr error
+	for _, upstream := range s.Upstream {
+		conn, err := net.DialTimeout(proto, upstream, upstreamTimeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(upstreamTimeout))
+		resp, err := exchange(conn, query, proto)
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("forwarding query: %w", lastErr)
+}
+
+func exchange(conn net.Conn, query []byte, proto string) ([]byte, error) {
+	if proto == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(bufio.NewReader(conn))
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// HostUpstream returns the nameservers from the host's resolv.conf, falling
+// back to DefaultUpstream.
+func HostUpstream() []string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return DefaultUpstream
+	}
+	defer f.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	if len(servers) == 0 {
+		return DefaultUpstream
+	}
+	return servers
+}
@@ -0,0 +1,98 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func query(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("packing query: %v", err)
+	}
+	return b
+}
+
+func TestHandleInternal(t *testing.T) {
+	s := NewServer("127.0.0.1:0", func(host string) []net.IP {
+		if host == "1234567" || host == "web" {
+			return []net.IP{net.ParseIP("10.0.0.2")}
+		}
+		return nil
+	}, nil)
+
+	for _, name := range []string{"1234567.internal.", "web.internal.", "WEB.internal."} {
+		b, err := s.handle(query(t, name, dnsmessage.TypeA), "udp")
+		if err != nil {
+			t.Fatalf("handle %s: %v", name, err)
+		}
+		var resp dnsmessage.Message
+		if err := resp.Unpack(b); err != nil {
+			t.Fatalf("unpacking response: %v", err)
+		}
+		if resp.Header.ID != 42 || resp.Header.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 1 {
+			t.Fatalf("unexpected response for %s: %+v", name, resp)
+		}
+		a := resp.Answers[0].Body.(*dnsmessage.AResource)
+		if net.IP(a.A[:]).String() != "10.0.0.2" {
+			t.Errorf("got %v for %s, want 10.0.0.2", a.A, name)
+		}
+	}
+
+	b, err := s.handle(query(t, "missing.internal.", dnsmessage.TypeA), "udp")
+	if err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(b); err != nil {
+		t.Fatalf("unpacking response: %v", err)
+	}
+	if resp.Header.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("got rcode %v, want NXDOMAIN", resp.Header.RCode)
+	}
+}
+
+func TestHandleAAAA(t *testing.T) {
+	s := NewServer("127.0.0.1:0", func(host string) []net.IP {
+		return []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("fd00::2")}
+	}, nil)
+
+	b, err := s.handle(query(t, "web.internal.", dnsmessage.TypeAAAA), "udp")
+	if err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(b); err != nil {
+		t.Fatalf("unpacking response: %v", err)
+	}
+	if len(resp.Answers) != 1 {
+		t.Fatalf("got %d answers, want 1", len(resp.Answers))
+	}
+	aaaa, ok := resp.Answers[0].Body.(*dnsmessage.AAAAResource)
+	if !ok || net.IP(aaaa.AAAA[:]).String() != "fd00::2" {
+		t.Errorf("got %v, want AAAA fd00::2", resp.Answers[0].Body)
+	}
+}
+
+func TestMachineHost(t *testing.T) {
+	for name, want := range map[string]string{
+		"web.internal.":     "web",
+		"web.":              "web",
+		"a.b.internal.":     "",
+		"example.com.":      "",
+		"1234567.internal.": "1234567",
+	} {
+		if got, _ := machineHost(name); got != want {
+			t.Errorf("machineHost(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package firecracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// TokenBucket is a Firecracker token bucket. Size is in bytes for bandwidth
+// and in operations for ops limiters, RefillTime is in milliseconds. A
+// bucket with a zero size or refill time doesn't limit anything.
+type TokenBucket struct {
+	Size         int64 `json:"size"`
+	OneTimeBurst int64 `json:"one_time_burst,omitempty"`
+	RefillTime   int64 `json:"refill_time"`
+}
+
+type RateLimiter struct {
+	Bandwidth *TokenBucket `json:"bandwidth,omitempty"`
+	Ops       *TokenBucket `json:"ops,omitempty"`
+}
+
+// RateLimits are applied to the machine's rootfs drive and eth0.
+type RateLimits struct {
+	Disk  *RateLimiter `json:"disk,omitempty"`
+	NetRx *RateLimiter `json:"net_rx,omitempty"`
+	NetTx *RateLimiter `json:"net_tx,omitempty"`
+}
+
+func (l RateLimits) Validate() error {
+	for name, limiter := range map[string]*RateLimiter{"disk": l.Disk, "net_rx": l.NetRx, "net_tx": l.NetTx} {
+		if limiter == nil {
+			continue
+		}
+		for kind, bucket := range map[string]*TokenBucket{"bandwidth": limiter.Bandwidth, "ops": limiter.Ops} {
+			if bucket == nil {
+				continue
+			}
+			if bucket.Size < 0 || bucket.OneTimeBurst < 0 || bucket.RefillTime < 0 {
+				return fmt.Errorf("%s %s limit must not be negative", name, kind)
+			}
+			if (bucket.Size == 0) != (bucket.RefillTime == 0) {
+				return fmt.Errorf("%s %s limit needs both size and refill_time, or neither to remove it", name, kind)
+			}
+		}
+	}
+	return nil
+}
+
+// Client talks to a running Firecracker process over its API socket.
+type Client struct {
+	http *http.Client
+}
+
+func NewClient(socketPath string) *Client {
+	return &Client{
+		http: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// PatchDriveRateLimiter updates the rate limiter of a drive of the running
+// machine.
+func (c *Client) PatchDriveRateLimiter(ctx context.Context, driveID string, limiter *RateLimiter) error {
+	body := map[string]interface{}{
+		"drive_id":     driveID,
+		"rate_limiter": limiter,
+	}
+	return c.patch(ctx, "/drives/"+driveID, body)
+}
+
+// PatchNetworkInterfaceRateLimiters updates the receive and transmit rate
+// limiters of a network interface of the running machine. A nil limiter is
+// left unchanged.
+func (c *Client) PatchNetworkInterfaceRateLimiters(ctx context.Context, ifaceID string, rx, tx *RateLimiter) error {
+	body := map[string]interface{}{
+		"iface_id": ifaceID,
+	}
+	if rx != nil {
+		body["rx_rate_limiter"] = rx
+	}
+	if tx != nil {
+		body["tx_rate_limiter"] = tx
+	}
+	return c.patch(ctx, "/network-interfaces/"+ifaceID, body)
+}
+
+// PatchVMState pauses ("Paused") or resumes ("Resumed") the machine.
+func (c *Client) PatchVMState(ctx context.Context, state string) error {
+	return c.patch(ctx, "/vm", map[string]interface{}{"state": state})
+}
+
+func (c *Client) patch(ctx context.Context, path string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("marshalling request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, "http://localhost"+path, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("PATCH %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("PATCH %s: %s: %s", path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
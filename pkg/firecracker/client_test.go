@@ -0,0 +1,55 @@
+package firecracker
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestPatchNetworkInterfaceRateLimiters(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "api.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("listening on socket: %v", err)
+	}
+
+	var gotMethod, gotPath string
+	var gotBody map[string]json.RawMessage
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod, gotPath = r.Method, r.URL.Path
+		json.NewDecoder(r.Body).Decode(&gotBody)
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	rx := &RateLimiter{Bandwidth: &TokenBucket{Size: 1 << 20, RefillTime: 1000}}
+	if err := NewClient(socketPath).PatchNetworkInterfaceRateLimiters(context.Background(), "eth0", rx, nil); err != nil {
+		t.Fatalf("PatchNetworkInterfaceRateLimiters failed: %v", err)
+	}
+
+	if gotMethod != http.MethodPatch || gotPath != "/network-interfaces/eth0" {
+		t.Errorf("got %s %s, want PATCH /network-interfaces/eth0", gotMethod, gotPath)
+	}
+	if string(gotBody["rx_rate_limiter"]) != `{"bandwidth":{"size":1048576,"refill_time":1000}}` {
+		t.Errorf("unexpected rx_rate_limiter %s", gotBody["rx_rate_limiter"])
+	}
+	if _, ok := gotBody["tx_rate_limiter"]; ok {
+		t.Errorf("tx_rate_limiter should be left out")
+	}
+}
+
+func TestRateLimitsValidate(t *testing.T) {
+	ok := RateLimits{Disk: &RateLimiter{Ops: &TokenBucket{Size: 100, RefillTime: 1000}}}
+	if err := ok.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+
+	bad := RateLimits{NetTx: &RateLimiter{Bandwidth: &TokenBucket{Size: 100}}}
+	if err := bad.Validate(); err == nil {
+		t.Errorf("bucket without refill_time should be rejected")
+	}
+}
@@ -0,0 +1,696 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/sushant12/machine/pkg/dns"
+)
+
+const (
+	DefaultName   = "default"
+	DefaultSubnet = "172.17.0.0/24"
+
+	isolationStage1 = "MACHINE-ISOLATION-1"
+	isolationStage2 = "MACHINE-ISOLATION-2"
+
+	// DNSPort is where the per network DNS server listens on the gateway.
+	// Queries to port 53 are redirected to it so the server doesn't need
+	// to bind a privileged port.
+	DNSPort = 10053
+)
+
+var (
+	ErrNotFound     = errors.New("network not found")
+	ErrExists       = errors.New("network already exists")
+	ErrFull         = errors.New("no free addresses left in network")
+	ErrNameTaken    = errors.New("machine name already in use on network")
+	ErrAddressInUse = errors.New("address already in use")
+
+	validName        = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+	validMachineName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+)
+
+// Network is a named bridge on the host with its own subnet. Machines
+// attached to different networks cannot reach each other.
+type Network struct {
+	Name     string `json:"name"`
+	Subnet   string `json:"subnet"`
+	Gateway  string `json:"gateway"`
+	Subnet6  string `json:"subnet6,omitempty"`
+	Gateway6 string `json:"gateway6,omitempty"`
+	Bridge   string `json:"bridge"`
+}
+
+// Lease is an address handed out to one of a machine's interfaces.
+type Lease struct {
+	MachineID string
+	Name      string
+	Network   string
+	Bridge    string
+	Interface string
+	TapDevice string
+	MAC       string
+	IP        net.IP
+	Gateway   net.IP
+	Mask      int
+
+	// IPv6 address of the machine, only set on dual-stack networks.
+	IP6      net.IP
+	Gateway6 net.IP
+	Mask6    int
+}
+
+// IPs returns all addresses of the lease.
+func (l *Lease) IPs() []net.IP {
+	ips := []net.IP{l.IP}
+	if l.IP6 != nil {
+		ips = append(ips, l.IP6)
+	}
+	return ips
+}
+
+type network struct {
+	Network
+	subnet  *net.IPNet
+	subnet6 *net.IPNet
+	ready   bool
+	used    map[string]string
+	dns     *dns.Server
+}
+
+type Manager struct {
+	mu       sync.Mutex
+	networks map[string]*network
+	leases   map[string][]*Lease
+
+	// Upstream are the resolvers the per network DNS servers forward
+	// queries outside the internal zone to.
+	Upstream []string
+}
+
+// NewManager returns a Manager that knows about the default network. The
+// default network's bridge is only set up once a machine is attached to it.
+func NewManager() *Manager {
+	m := &Manager{
+		networks: map[string]*network{},
+		leases:   map[string][]*Lease{},
+		Upstream: dns.HostUpstream(),
+	}
+	n, err := newNetwork(DefaultName, DefaultSubnet, "")
+	if err != nil {
+		panic(err)
+	}
+	m.networks[DefaultName] = n
+	return m
+}
+
+// maxHosts caps how far into a subnet addresses are searched for, which
+// matters for IPv6 prefixes and IPv4 subnets larger than a /16.
+const maxHosts = 1 << 16
+
+func newNetwork(name, subnet, subnet6 string) (*network, error) {
+	if !validName.MatchString(name) {
+		return nil, fmt.Errorf("invalid network name %q", name)
+	}
+	ip, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("parsing subnet: %w", err)
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("subnet %s is not an IPv4 subnet", subnet)
+	}
+	if ones, _ := ipnet.Mask.Size(); ones > 29 {
+		return nil, fmt.Errorf("subnet %s is too small", subnet)
+	}
+	gateway := nthIP(ipnet, 1)
+	n := &network{
+		Network: Network{
+			Name:    name,
+			Subnet:  ipnet.String(),
+			Gateway: gateway.String(),
+			Bridge:  bridgeName(name),
+		},
+		subnet: ipnet,
+		used:   map[string]string{gateway.String(): ""},
+	}
+
+	if subnet6 != "" {
+		ip, ipnet, err := net.ParseCIDR(subnet6)
+		if err != nil {
+			return nil, fmt.Errorf("parsing subnet6: %w", err)
+		}
+		if ip.To4() != nil {
+			return nil, fmt.Errorf("subnet6 %s is not an IPv6 prefix", subnet6)
+		}
+		if ones, _ := ipnet.Mask.Size(); ones > 120 {
+			return nil, fmt.Errorf("subnet6 %s is too small", subnet6)
+		}
+		gateway := nthIP(ipnet, 1)
+		n.Subnet6 = ipnet.String()
+		n.Gateway6 = gateway.String()
+		n.subnet6 = ipnet
+		n.used[gateway.String()] = ""
+	}
+	return n, nil
+}
+
+// bridgeName derives a stable interface name from the network name, since
+// network names may be longer than the kernel's 15 character limit.
+func bridgeName(name string) string {
+	sum := sha1.Sum([]byte(name))
+	return "mbr" + hex.EncodeToString(sum[:4])
+}
+
+// TapDeviceName returns the host side device of the machine's index-th
+// interface.
+func TapDeviceName(machineID string, index int) string {
+	if index == 0 {
+		return fmt.Sprintf("tap%s", machineID)
+	}
+	return fmt.Sprintf("tap%s-%d", machineID, index)
+}
+
+// Create registers a new network and sets up its bridge on the host. The
+// network is dual-stack if subnet6 is not empty.
+func (m *Manager) Create(name, subnet, subnet6 string) (Network, error) {
+	n, err := newNetwork(name, subnet, subnet6)
+	if err != nil {
+		return Network{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.networks[name]; ok {
+		return Network{}, fmt.Errorf("%w: %s", ErrExists, name)
+	}
+	for _, other := range m.networks {
+		if other.subnet.Contains(n.subnet.IP) || n.subnet.Contains(other.subnet.IP) {
+			return Network{}, fmt.Errorf("subnet %s overlaps with network %s (%s)", n.Subnet, other.Name, other.Subnet)
+		}
+		if n.subnet6 != nil && other.subnet6 != nil &&
+			(other.subnet6.Contains(n.subnet6.IP) || n.subnet6.Contains(other.subnet6.IP)) {
+			return Network{}, fmt.Errorf("subnet6 %s overlaps with network %s (%s)", n.Subnet6, other.Name, other.Subnet6)
+		}
+	}
+
+	if err := m.setup(n); err != nil {
+		return Network{}, err
+	}
+	m.networks[name] = n
+	return n.Network, nil
+}
+
+func (m *Manager) Get(name string) (Network, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, ok := m.networks[name]
+	if !ok {
+		return Network{}, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return n.Network, nil
+}
+
+func (m *Manager) List() []Network {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := make([]Network, 0, len(m.networks))
+	for _, n := range m.networks {
+		list = append(list, n.Network)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Interface describes a network interface to allocate for a machine.
+type Interface struct {
+	// Network to attach to, the default network if empty.
+	Network string
+	// MAC is the guest's MAC address for the interface. If empty, one is
+	// derived from the machine ID.
+	MAC string
+	// IP optionally requests a static IPv4 address on the network.
+	IP string
+}
+
+// Allocate reserves addresses for each of the machine's interfaces, in
+// order, so the first lease is eth0. Either all interfaces are allocated or
+// none. The machine is resolvable on its networks by ID and, if given, by
+// machineName.
+func (m *Manager) Allocate(machineID, machineName string, ifaces []Interface) ([]*Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if leases, ok := m.leases[machineID]; ok {
+		return leases, nil
+	}
+	if machineName != "" && !validMachineName.MatchString(machineName) {
+		return nil, fmt.Errorf("invalid machine name %q", machineName)
+	}
+
+	var leases []*Lease
+	macs := m.macs()
+	rollback := func() {
+		for _, lease := range leases {
+			for _, ip := range lease.IPs() {
+				delete(m.networks[lease.Network].used, ip.String())
+			}
+		}
+	}
+	for i, iface := range ifaces {
+		mac, err := pickMAC(macs, machineID, i, iface.MAC)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		iface.MAC = mac
+
+		lease, err := m.allocate(machineID, machineName, i, iface)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		macs[mac] = true
+		for _, other := range leases {
+			if other.Network == lease.Network {
+				leases = append(leases, lease)
+				rollback()
+				return nil, fmt.Errorf("machine is attached to network %s more than once", lease.Network)
+			}
+		}
+		leases = append(leases, lease)
+	}
+	m.leases[machineID] = leases
+	return leases, nil
+}
+
+func (m *Manager) allocate(machineID, machineName string, index int, iface Interface) (*Lease, error) {
+	name := iface.Network
+	if name == "" {
+		name = DefaultName
+	}
+	n, ok := m.networks[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if machineName != "" && m.lookup(name, machineName) != nil {
+		return nil, fmt.Errorf("%w: %s", ErrNameTaken, machineName)
+	}
+
+	var ip net.IP
+	if iface.IP != "" {
+		ip = net.ParseIP(iface.IP).To4()
+		if ip == nil || !n.subnet.Contains(ip) || ip.Equal(n.subnet.IP) || ip.Equal(broadcast(n.subnet)) {
+			return nil, fmt.Errorf("address %s is not usable on network %s (%s)", iface.IP, n.Name, n.Subnet)
+		}
+		if _, taken := n.used[ip.String()]; taken {
+			return nil, fmt.Errorf("%w: %s on network %s", ErrAddressInUse, ip, n.Name)
+		}
+	} else if ip = freeIP(n.subnet, n.used); ip == nil {
+		return nil, fmt.Errorf("%w: %s", ErrFull, name)
+	}
+
+	ones, _ := n.subnet.Mask.Size()
+	lease := &Lease{
+		MachineID: machineID,
+		Name:      machineName,
+		Network:   n.Name,
+		Bridge:    n.Bridge,
+		Interface: fmt.Sprintf("eth%d", index),
+		TapDevice: TapDeviceName(machineID, index),
+		MAC:       iface.MAC,
+		IP:        ip,
+		Gateway:   net.ParseIP(n.Gateway),
+		Mask:      ones,
+	}
+	if n.subnet6 != nil {
+		ip6 := freeIP(n.subnet6, n.used)
+		if ip6 == nil {
+			return nil, fmt.Errorf("%w: %s", ErrFull, name)
+		}
+		lease.IP6 = ip6
+		lease.Gateway6 = net.ParseIP(n.Gateway6)
+		lease.Mask6, _ = n.subnet6.Mask.Size()
+	}
+
+	for _, ip := range lease.IPs() {
+		n.used[ip.String()] = machineID
+	}
+	return lease, nil
+}
+
+// macs returns the MAC addresses of all leases on the host.
+func (m *Manager) macs() map[string]bool {
+	macs := map[string]bool{}
+	for _, leases := range m.leases {
+		for _, lease := range leases {
+			macs[lease.MAC] = true
+		}
+	}
+	return macs
+}
+
+// pickMAC validates a requested MAC address, or derives one for the
+// machine's index-th interface that isn't used on the host yet.
+func pickMAC(used map[string]bool, machineID string, index int, requested string) (string, error) {
+	if requested != "" {
+		hw, err := net.ParseMAC(requested)
+		if err != nil || len(hw) != 6 || hw[0]&1 != 0 {
+			return "", fmt.Errorf("invalid MAC address %q", requested)
+		}
+		if used[hw.String()] {
+			return "", fmt.Errorf("%w: %s", ErrAddressInUse, hw)
+		}
+		return hw.String(), nil
+	}
+	for attempt := 0; ; attempt++ {
+		mac := MACAddress(machineID, index, attempt)
+		if !used[mac] {
+			return mac, nil
+		}
+	}
+}
+
+// MACAddress derives a locally administered unicast MAC address from the
+// machine ID and interface index, so a machine keeps its MACs across
+// restarts. attempt is bumped on the rare collision with another machine.
+func MACAddress(machineID string, index, attempt int) string {
+	seed := fmt.Sprintf("%s/%d", machineID, index)
+	if attempt > 0 {
+		seed = fmt.Sprintf("%s/%d", seed, attempt)
+	}
+	sum := sha256.Sum256([]byte(seed))
+	hw := net.HardwareAddr(sum[:6])
+	hw[0] = hw[0]&0xfc | 0x02
+	return hw.String()
+}
+
+// broadcast returns the broadcast address of an IPv4 subnet.
+func broadcast(subnet *net.IPNet) net.IP {
+	base := subnet.IP.To4()
+	ip := make(net.IP, len(base))
+	for i := range base {
+		ip[i] = base[i] | ^subnet.Mask[len(subnet.Mask)-len(base)+i]
+	}
+	return ip
+}
+
+// lastHost returns the index of the last address handed out in subnet.
+func lastHost(subnet *net.IPNet) uint64 {
+	ones, bits := subnet.Mask.Size()
+	if bits-ones >= 16 {
+		return maxHosts - 2
+	}
+	return uint64(1)<<uint(bits-ones) - 2
+}
+
+// freeIP returns the first address in subnet that isn't used, skipping the
+// network address and leaving the last (broadcast) address alone.
+func freeIP(subnet *net.IPNet, used map[string]string) net.IP {
+	for i := uint64(1); i <= lastHost(subnet); i++ {
+		ip := nthIP(subnet, i)
+		if _, taken := used[ip.String()]; !taken {
+			return ip
+		}
+	}
+	return nil
+}
+
+// Leases returns the machine's leases, ordered by interface.
+func (m *Manager) Leases(machineID string) []*Lease {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.leases[machineID]
+}
+
+// Attach creates the machine's tap devices and plugs them into the bridges
+// of the networks they were allocated on, setting the bridges up if needed.
+func (m *Manager) Attach(machineID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	leases, ok := m.leases[machineID]
+	if !ok {
+		return fmt.Errorf("no address allocated for machine %s", machineID)
+	}
+	for _, lease := range leases {
+		n := m.networks[lease.Network]
+		if err := m.setup(n); err != nil {
+			return err
+		}
+
+		_ = run("sudo", "ip", "link", "del", lease.TapDevice)
+		if err := run("sudo", "ip", "tuntap", "add", "dev", lease.TapDevice, "mode", "tap"); err != nil {
+			return fmt.Errorf("creating tap device: %w", err)
+		}
+		if err := run("sudo", "ip", "link", "set", lease.TapDevice, "master", lease.Bridge); err != nil {
+			return fmt.Errorf("attaching tap device to bridge: %w", err)
+		}
+		if err := run("sudo", "ip", "link", "set", lease.TapDevice, "up"); err != nil {
+			return fmt.Errorf("bringing up tap device: %w", err)
+		}
+		// Pin the host's neighbor entries, so another guest answering
+		// for the machine's addresses can't draw its traffic.
+		for _, ip := range lease.IPs() {
+			if err := run("sudo", "ip", "neigh", "replace", ip.String(), "lladdr", lease.MAC, "dev", lease.Bridge, "nud", "permanent"); err != nil {
+				return fmt.Errorf("pinning neighbor entry: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Release removes the machine's tap devices and returns its addresses to
+// the pool. It is a no-op for machines without a lease.
+func (m *Manager) Release(machineID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	leases, ok := m.leases[machineID]
+	if !ok {
+		return nil
+	}
+	delete(m.leases, machineID)
+
+	var errs []error
+	for _, lease := range leases {
+		if n, ok := m.networks[lease.Network]; ok {
+			for _, ip := range lease.IPs() {
+				delete(n.used, ip.String())
+			}
+		}
+		if err := run("sudo", "ip", "link", "del", lease.TapDevice); err != nil {
+			errs = append(errs, fmt.Errorf("removing tap device: %w", err))
+		}
+		for _, ip := range lease.IPs() {
+			_ = run("sudo", "ip", "neigh", "del", ip.String(), "dev", lease.Bridge)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Lookup returns the addresses of the machine with the given ID or name on
+// the named network.
+func (m *Manager) Lookup(name, host string) []net.IP {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.lookup(name, host)
+}
+
+func (m *Manager) lookup(name, host string) []net.IP {
+	for _, leases := range m.leases {
+		for _, lease := range leases {
+			if lease.Network != name {
+				continue
+			}
+			if lease.MachineID == host || (lease.Name != "" && lease.Name == host) {
+				return lease.IPs()
+			}
+		}
+	}
+	return nil
+}
+
+// setup creates the bridge for the network, routes its subnet out of the
+// host, isolates it from every other machine network and starts its DNS
+// server on the gateway.
+func (m *Manager) setup(n *network) error {
+	if n.ready {
+		return nil
+	}
+	ones, _ := n.subnet.Mask.Size()
+	gateway := fmt.Sprintf("%s/%d", n.Gateway, ones)
+
+	if err := run("sudo", "ip", "link", "show", n.Bridge); err != nil {
+		if err := run("sudo", "ip", "link", "add", n.Bridge, "type", "bridge"); err != nil {
+			return fmt.Errorf("creating bridge: %w", err)
+		}
+	}
+	if err := run("sudo", "ip", "addr", "replace", gateway, "dev", n.Bridge); err != nil {
+		return fmt.Errorf("assigning gateway address: %w", err)
+	}
+	if err := run("sudo", "ip", "link", "set", n.Bridge, "up"); err != nil {
+		return fmt.Errorf("bringing up bridge: %w", err)
+	}
+
+	if err := run("sudo", "sysctl", "-w", "net.ipv4.ip_forward=1"); err != nil {
+		return fmt.Errorf("enabling ip forwarding: %w", err)
+	}
+	if err := setupFirewall("iptables", n.Bridge, n.Subnet); err != nil {
+		return fmt.Errorf("setting up isolation for %s: %w", n.Name, err)
+	}
+
+	if n.subnet6 != nil {
+		ones6, _ := n.subnet6.Mask.Size()
+		// Without nodad the gateway address stays tentative for a while and
+		// can't be bound by the DNS server.
+		if err := run("sudo", "ip", "-6", "addr", "replace", fmt.Sprintf("%s/%d", n.Gateway6, ones6), "dev", n.Bridge, "nodad"); err != nil {
+			return fmt.Errorf("assigning IPv6 gateway address: %w", err)
+		}
+		if err := run("sudo", "sysctl", "-w", "net.ipv6.conf.all.forwarding=1"); err != nil {
+			return fmt.Errorf("enabling IPv6 forwarding: %w", err)
+		}
+		if err := setupFirewall("ip6tables", n.Bridge, n.Subnet6); err != nil {
+			return fmt.Errorf("setting up IPv6 isolation for %s: %w", n.Name, err)
+		}
+	}
+
+	if err := m.startDNS(n); err != nil {
+		return err
+	}
+
+	n.ready = true
+	return nil
+}
+
+func (m *Manager) startDNS(n *network) error {
+	if n.dns != nil {
+		return nil
+	}
+	for _, proto := range []string{"udp", "tcp"} {
+		rule := []string{"-t", "nat", "PREROUTING", "-i", n.Bridge, "-d", n.Gateway, "-p", proto, "--dport", "53", "-j", "REDIRECT", "--to-ports", strconv.Itoa(DNSPort)}
+		if err := ensureRule("iptables", "-A", rule...); err != nil {
+			return fmt.Errorf("redirecting dns for %s: %w", n.Name, err)
+		}
+		// The gateway is reachable from other networks through the host, so
+		// only machines on the bridge may query the server.
+		rule = []string{"-t", "filter", "INPUT", "!", "-i", n.Bridge, "-d", n.Gateway, "-p", proto, "--dport", strconv.Itoa(DNSPort), "-j", "DROP"}
+		if err := ensureRule("iptables", "-I", rule...); err != nil {
+			return fmt.Errorf("restricting dns for %s: %w", n.Name, err)
+		}
+	}
+
+	name := n.Name
+	lookup := func(host string) []net.IP {
+		return m.Lookup(name, host)
+	}
+	server := dns.NewServer(net.JoinHostPort(n.Gateway, strconv.Itoa(DNSPort)), lookup, m.Upstream)
+	if err := server.Start(); err != nil {
+		return fmt.Errorf("starting dns server for %s: %w", n.Name, err)
+	}
+	n.dns = server
+	return nil
+}
+
+// setupFirewall masquerades the bridge's subnet and isolates it from other
+// machine networks, using iptables or ip6tables.
+func setupFirewall(iptables, bridge, subnet string) error {
+	if err := ensureIsolationChains(iptables); err != nil {
+		return err
+	}
+	rules := [][]string{
+		{"-t", "nat", "POSTROUTING", "-s", subnet, "!", "-o", bridge, "-j", "MASQUERADE"},
+		{"-t", "filter", "FORWARD", "-i", bridge, "-j", "ACCEPT"},
+		{"-t", "filter", "FORWARD", "-o", bridge, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+		{"-t", "filter", isolationStage1, "-i", bridge, "!", "-o", bridge, "-j", isolationStage2},
+		{"-t", "filter", isolationStage2, "-o", bridge, "-j", "DROP"},
+	}
+	for _, rule := range rules {
+		if err := ensureRule(iptables, "-A", rule...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureIsolationChains creates the two stage isolation chains. Traffic
+// entering from a machine bridge and leaving through a different one is
+// sent to stage 2, which drops it if the egress interface is also a
+// machine bridge.
+func ensureIsolationChains(iptables string) error {
+	for _, chain := range []string{isolationStage1, isolationStage2} {
+		if err := run("sudo", iptables, "-t", "filter", "-n", "-L", chain); err != nil {
+			if err := run("sudo", iptables, "-t", "filter", "-N", chain); err != nil {
+				return fmt.Errorf("creating chain %s: %w", chain, err)
+			}
+		}
+	}
+	// The jump has to come before the per network ACCEPT rules.
+	return ensureRule(iptables, "-I", "-t", "filter", "FORWARD", "-j", isolationStage1)
+}
+
+// ensureRule adds the rule to the chain with op (-A or -I) unless it is
+// already present. The first two arguments of rule select the table.
+func ensureRule(iptables, op string, rule ...string) error {
+	table, chain, spec := rule[:2], rule[2], rule[3:]
+	check := append(append(append([]string{iptables}, table...), "-C", chain), spec...)
+	if err := run("sudo", check...); err == nil {
+		return nil
+	}
+	add := append(append(append([]string{iptables}, table...), op, chain), spec...)
+	return run("sudo", add...)
+}
+
+// nthIP returns the n-th address of the subnet, for both address families.
+func nthIP(subnet *net.IPNet, n uint64) net.IP {
+	base := subnet.IP.To4()
+	if base == nil {
+		base = subnet.IP.To16()
+	}
+	ip := make(net.IP, len(base))
+	copy(ip, base)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], n)
+	carry := 0
+	for i := 1; i <= len(ip); i++ {
+		sum := int(ip[len(ip)-i]) + carry
+		if i <= 8 {
+			sum += int(buf[8-i])
+		}
+		ip[len(ip)-i] = byte(sum)
+		carry = sum >> 8
+	}
+	return ip
+}
+
+func run(name string, args ...string) error {
+	_, err := output(name, args...)
+	return err
+}
+
+func output(name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s %v: %s: %s", name, args, err, stderr.String())
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,183 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestAllocate(t *testing.T) {
+	m := NewManager()
+
+	leases, err := m.Allocate("1111111", "", []Interface{{}})
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	lease := leases[0]
+	if lease.Network != DefaultName {
+		t.Errorf("got network %s, want %s", lease.Network, DefaultName)
+	}
+	if lease.IP.String() != "172.17.0.2" || lease.Gateway.String() != "172.17.0.1" || lease.Mask != 24 {
+		t.Errorf("unexpected lease: %s via %s/%d", lease.IP, lease.Gateway, lease.Mask)
+	}
+
+	again, err := m.Allocate("1111111", "", []Interface{{}})
+	if err != nil || again[0] != lease {
+		t.Errorf("allocating twice for the same machine should return the same lease")
+	}
+
+	if _, err := m.Allocate("2222222", "", []Interface{{Network: "missing"}}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want ErrNotFound", err)
+	}
+}
+
+func TestAllocateExhaustsSubnet(t *testing.T) {
+	m := NewManager()
+	n, err := newNetwork("tiny", "10.10.0.0/29", "")
+	if err != nil {
+		t.Fatalf("newNetwork failed: %v", err)
+	}
+	m.networks[n.Name] = n
+
+	// A /29 has 8 addresses: network, gateway, broadcast and 5 for machines.
+	for i, want := range []string{"10.10.0.2", "10.10.0.3", "10.10.0.4", "10.10.0.5", "10.10.0.6"} {
+		leases, err := m.Allocate(string(rune('a'+i)), "", []Interface{{Network: "tiny"}})
+		if err != nil {
+			t.Fatalf("Allocate %d failed: %v", i, err)
+		}
+		if leases[0].IP.String() != want {
+			t.Errorf("got %s, want %s", leases[0].IP, want)
+		}
+	}
+	if _, err := m.Allocate("z", "", []Interface{{Network: "tiny"}}); !errors.Is(err, ErrFull) {
+		t.Errorf("got %v, want ErrFull", err)
+	}
+}
+
+func TestAllocateDualStack(t *testing.T) {
+	m := NewManager()
+	n, err := newNetwork("v6", "10.20.0.0/24", "fd00:20::/64")
+	if err != nil {
+		t.Fatalf("newNetwork failed: %v", err)
+	}
+	m.networks[n.Name] = n
+
+	leases, err := m.Allocate("1111111", "web", []Interface{{Network: "v6"}})
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	lease := leases[0]
+	if lease.IP.String() != "10.20.0.2" || lease.IP6.String() != "fd00:20::2" {
+		t.Errorf("got %s and %s, want 10.20.0.2 and fd00:20::2", lease.IP, lease.IP6)
+	}
+	if lease.Gateway6.String() != "fd00:20::1" || lease.Mask6 != 64 {
+		t.Errorf("got gateway %s/%d, want fd00:20::1/64", lease.Gateway6, lease.Mask6)
+	}
+	if ips := m.Lookup("v6", "web"); len(ips) != 2 {
+		t.Errorf("got %v, want both addresses", ips)
+	}
+}
+
+func TestAllocateMultipleInterfaces(t *testing.T) {
+	m := NewManager()
+	n, err := newNetwork("data", "10.30.0.0/24", "")
+	if err != nil {
+		t.Fatalf("newNetwork failed: %v", err)
+	}
+	m.networks[n.Name] = n
+
+	leases, err := m.Allocate("1111111", "", []Interface{{}, {Network: "data", IP: "10.30.0.50"}})
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if len(leases) != 2 {
+		t.Fatalf("got %d leases, want 2", len(leases))
+	}
+	if leases[0].Interface != "eth0" || leases[0].TapDevice != "tap1111111" {
+		t.Errorf("unexpected first interface %s on %s", leases[0].Interface, leases[0].TapDevice)
+	}
+	if leases[1].Interface != "eth1" || leases[1].TapDevice != "tap1111111-1" || leases[1].IP.String() != "10.30.0.50" {
+		t.Errorf("unexpected second interface %s on %s with %s", leases[1].Interface, leases[1].TapDevice, leases[1].IP)
+	}
+
+	// The static address is taken now, and a failed allocation must not
+	// leak the default network address it got for eth0.
+	if _, err := m.Allocate("2222222", "", []Interface{{}, {Network: "data", IP: "10.30.0.50"}}); !errors.Is(err, ErrAddressInUse) {
+		t.Errorf("got %v, want ErrAddressInUse", err)
+	}
+	leases, err = m.Allocate("3333333", "", []Interface{{}})
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if leases[0].IP.String() != "172.17.0.3" {
+		t.Errorf("got %s, want 172.17.0.3", leases[0].IP)
+	}
+
+	for _, ip := range []string{"10.30.0.0", "10.30.0.1", "10.30.0.255", "10.31.0.2"} {
+		if _, err := m.Allocate("4444444", "", []Interface{{Network: "data", IP: ip}}); err == nil {
+			t.Errorf("static address %s should be rejected", ip)
+		}
+	}
+}
+
+func TestAllocateStaticIPLargeSubnet(t *testing.T) {
+	m := NewManager()
+	n, err := newNetwork("wide", "10.0.0.0/8", "")
+	if err != nil {
+		t.Fatalf("newNetwork failed: %v", err)
+	}
+	m.networks[n.Name] = n
+
+	// Addresses past the allocation scan are still usable statically.
+	if _, err := m.Allocate("1111111", "", []Interface{{Network: "wide", IP: "10.200.0.2"}}); err != nil {
+		t.Errorf("Allocate failed: %v", err)
+	}
+	if _, err := m.Allocate("2222222", "", []Interface{{Network: "wide", IP: "10.255.255.255"}}); err == nil {
+		t.Error("broadcast address should be rejected")
+	}
+}
+
+func TestAllocateMAC(t *testing.T) {
+	m := NewManager()
+
+	leases, err := m.Allocate("1111111", "", []Interface{{}})
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	mac := leases[0].MAC
+	if mac != MACAddress("1111111", 0, 0) {
+		t.Errorf("got %s, want the MAC derived from the machine ID", mac)
+	}
+	if hw, _ := net.ParseMAC(mac); hw[0]&0x03 != 0x02 {
+		t.Errorf("%s is not a locally administered unicast address", mac)
+	}
+
+	// Another machine asking for the same MAC is refused, and a derived
+	// MAC that collides is bumped to the next candidate.
+	if _, err := m.Allocate("2222222", "", []Interface{{MAC: mac}}); !errors.Is(err, ErrAddressInUse) {
+		t.Errorf("got %v, want ErrAddressInUse", err)
+	}
+	if _, err := m.Allocate("3333333", "", []Interface{{MAC: MACAddress("4444444", 0, 0)}}); err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	leases, err = m.Allocate("4444444", "", []Interface{{}})
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if leases[0].MAC != MACAddress("4444444", 0, 1) {
+		t.Errorf("got %s, want the next candidate after a collision", leases[0].MAC)
+	}
+}
+
+func TestNewNetworkValidation(t *testing.T) {
+	for _, tc := range []struct{ name, subnet string }{
+		{"Bad Name", "10.0.0.0/24"},
+		{"ok", "not-a-subnet"},
+		{"ok", "10.0.0.0/30"},
+		{"ok", "fd00::/64"},
+	} {
+		if _, err := newNetwork(tc.name, tc.subnet, ""); err == nil {
+			t.Errorf("newNetwork(%q, %q) should fail", tc.name, tc.subnet)
+		}
+	}
+}
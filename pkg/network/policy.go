@@ -0,0 +1,371 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PolicyRule matches traffic to (egress) or from (ingress) a CIDR,
+// optionally narrowed down to a protocol and destination ports.
+type PolicyRule struct {
+	CIDR     string `json:"cidr"`
+	Protocol string `json:"protocol,omitempty"`
+	Ports    []int  `json:"ports,omitempty"`
+}
+
+// PolicyRules are evaluated deny first, then allow. If there are allow
+// rules, anything they don't match is dropped.
+type PolicyRules struct {
+	Allow []PolicyRule `json:"allow,omitempty"`
+	Deny  []PolicyRule `json:"deny,omitempty"`
+}
+
+// Policy restricts the routed traffic of a machine and its traffic to the
+// host. It doesn't apply to traffic between machines on the same network,
+// which never leaves the bridge.
+type Policy struct {
+	Egress  PolicyRules `json:"egress"`
+	Ingress PolicyRules `json:"ingress"`
+}
+
+func (p Policy) Empty() bool {
+	return len(p.Egress.Allow) == 0 && len(p.Egress.Deny) == 0 &&
+		len(p.Ingress.Allow) == 0 && len(p.Ingress.Deny) == 0
+}
+
+func (p Policy) Validate() error {
+	for _, rules := range []PolicyRules{p.Egress, p.Ingress} {
+		for _, rule := range append(append([]PolicyRule{}, rules.Allow...), rules.Deny...) {
+			if err := rule.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r PolicyRule) validate() error {
+	if _, _, err := net.ParseCIDR(r.CIDR); err != nil {
+		return fmt.Errorf("invalid policy cidr %q", r.CIDR)
+	}
+	switch r.Protocol {
+	case "", "tcp", "udp", "icmp":
+	default:
+		return fmt.Errorf("invalid policy protocol %q", r.Protocol)
+	}
+	if len(r.Ports) > 0 && r.Protocol != "tcp" && r.Protocol != "udp" {
+		return fmt.Errorf("policy ports for %s require protocol tcp or udp", r.CIDR)
+	}
+	if len(r.Ports) > 15 {
+		return fmt.Errorf("policy rule for %s has more than 15 ports", r.CIDR)
+	}
+	for _, port := range r.Ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid policy port %d", port)
+		}
+	}
+	return nil
+}
+
+func (r PolicyRule) ipv6() bool {
+	ip, _, _ := net.ParseCIDR(r.CIDR)
+	return ip.To4() == nil
+}
+
+// policyChain returns the name of the chain holding the machine's rules for
+// one direction, within the 28 characters iptables allows.
+func policyChain(machineID, direction string) string {
+	return fmt.Sprintf("MACHINE-%s-%s", machineID, direction)
+}
+
+// ApplyPolicy installs the policy on the host for every interface of the
+// machine and returns the active rules, in iptables-save syntax.
+func ApplyPolicy(leases []*Lease, policy Policy) ([]string, error) {
+	if policy.Empty() || len(leases) == 0 {
+		return nil, nil
+	}
+	machineID := leases[0].MachineID
+	if err := enableBridgeNetfilter(); err != nil {
+		return nil, err
+	}
+
+	var active []string
+	for _, family := range []struct {
+		iptables string
+		ipv6     bool
+	}{{"iptables", false}, {"ip6tables", true}} {
+		if family.ipv6 && !dualStack(leases) {
+			continue
+		}
+		rules, err := applyPolicy(family.iptables, family.ipv6, machineID, leases, policy)
+		if err != nil {
+			RemovePolicy(machineID)
+			return nil, err
+		}
+		active = append(active, rules...)
+	}
+	return active, nil
+}
+
+// enableBridgeNetfilter passes bridged traffic through iptables, which the
+// physdev matches on the machines' taps need.
+func enableBridgeNetfilter() error {
+	if err := run("sudo", "modprobe", "br_netfilter"); err != nil {
+		return fmt.Errorf("loading br_netfilter: %w", err)
+	}
+	if err := run("sudo", "sysctl", "-w", "net.bridge.bridge-nf-call-iptables=1", "net.bridge.bridge-nf-call-ip6tables=1"); err != nil {
+		return fmt.Errorf("enabling bridge netfilter: %w", err)
+	}
+	return nil
+}
+
+func applyPolicy(iptables string, ipv6 bool, machineID string, leases []*Lease, policy Policy) ([]string, error) {
+	var active []string
+	for _, dir := range []struct {
+		name  string
+		rules PolicyRules
+	}{{"EGRESS", policy.Egress}, {"INGRESS", policy.Ingress}} {
+		if len(dir.rules.Allow) == 0 && len(dir.rules.Deny) == 0 {
+			continue
+		}
+		chain := policyChain(machineID, dir.name)
+		_ = run("sudo", iptables, "-t", "filter", "-N", chain)
+		if err := run("sudo", iptables, "-t", "filter", "-F", chain); err != nil {
+			return nil, fmt.Errorf("creating chain %s: %w", chain, err)
+		}
+
+		specs := [][]string{{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN"}}
+		for _, rule := range dir.rules.Deny {
+			if rule.ipv6() == ipv6 {
+				specs = append(specs, append(rule.match(dir.name), "-j", "DROP"))
+			}
+		}
+		for _, rule := range dir.rules.Allow {
+			if rule.ipv6() == ipv6 {
+				specs = append(specs, append(rule.match(dir.name), "-j", "RETURN"))
+			}
+		}
+		// Allowed traffic returns to FORWARD rather than being accepted
+		// here, so network isolation still applies to it.
+		if len(dir.rules.Allow) > 0 {
+			specs = append(specs, []string{"-j", "DROP"})
+		}
+		for _, spec := range specs {
+			args := append([]string{iptables, "-t", "filter", "-A", chain}, spec...)
+			if err := run("sudo", args...); err != nil {
+				return nil, fmt.Errorf("adding policy rule: %w", err)
+			}
+			active = append(active, strings.Join(append([]string{"-A", chain}, spec...), " "))
+		}
+
+		for _, lease := range leases {
+			for _, hook := range policyHooks(lease, ipv6, dir.name, chain) {
+				if err := ensureRule(iptables, "-I", hook...); err != nil {
+					return nil, fmt.Errorf("hooking policy chain %s: %w", chain, err)
+				}
+				active = append(active, strings.Join(append([]string{"-A"}, hook[2:]...), " "))
+			}
+		}
+	}
+
+	// Guests must not get around their policy by sending with another
+	// machine's address. The spoofing check is inserted last so it comes
+	// first in FORWARD and INPUT.
+	chain := policyChain(machineID, "SPOOF")
+	_ = run("sudo", iptables, "-t", "filter", "-N", chain)
+	if err := run("sudo", iptables, "-t", "filter", "-F", chain); err != nil {
+		return nil, fmt.Errorf("creating chain %s: %w", chain, err)
+	}
+	for _, spec := range spoofRules(leases, ipv6) {
+		args := append([]string{iptables, "-t", "filter", "-A", chain}, spec...)
+		if err := run("sudo", args...); err != nil {
+			return nil, fmt.Errorf("adding spoofing rule: %w", err)
+		}
+		active = append(active, strings.Join(append([]string{"-A", chain}, spec...), " "))
+	}
+	for _, lease := range leases {
+		for _, builtin := range []string{"FORWARD", "INPUT"} {
+			hook := []string{"-t", "filter", builtin, "-m", "physdev", "--physdev-in", lease.TapDevice, "-j", chain}
+			if err := ensureRule(iptables, "-I", hook...); err != nil {
+				return nil, fmt.Errorf("hooking spoofing chain %s: %w", chain, err)
+			}
+			active = append(active, strings.Join(append([]string{"-A"}, hook[2:]...), " "))
+		}
+	}
+	return active, nil
+}
+
+// policyHooks returns the rules sending a lease's traffic to the policy
+// chain of one direction, in insertion order.
+//
+// Egress is matched on the tap device the traffic enters the bridge from,
+// so it holds whatever source address the guest uses. It covers routed
+// traffic in FORWARD and traffic to the host in INPUT, except DNS queries
+// to the network's own server.
+//
+// Ingress is matched on the destination address: the bridge port of routed
+// traffic isn't known in FORWARD, so --physdev-out can't match it. The
+// host's neighbor entry for the address is pinned to the lease's MAC when
+// the machine is attached, so the traffic can't be drawn to another tap.
+// Traffic from the host itself isn't covered.
+func policyHooks(lease *Lease, ipv6 bool, direction, chain string) [][]string {
+	ip := lease.IP
+	if ipv6 {
+		ip = lease.IP6
+	}
+	if ip == nil {
+		return nil
+	}
+	if direction == "INGRESS" {
+		return [][]string{{"-t", "filter", "FORWARD", "-o", lease.Bridge, "-d", ip.String(), "-j", chain}}
+	}
+
+	physdev := []string{"-m", "physdev", "--physdev-in", lease.TapDevice}
+	hooks := [][]string{
+		append(append([]string{"-t", "filter", "FORWARD"}, physdev...), "!", "--physdev-is-bridged", "-j", chain),
+		append(append([]string{"-t", "filter", "INPUT"}, physdev...), "-j", chain),
+	}
+	// Inserted after the INPUT jump, so it comes before it.
+	if !ipv6 {
+		for _, proto := range []string{"udp", "tcp"} {
+			hooks = append(hooks, append(append([]string{"-t", "filter", "INPUT"}, physdev...),
+				"-d", lease.Gateway.String(), "-p", proto, "--dport", strconv.Itoa(DNSPort), "-j", "ACCEPT"))
+		}
+	}
+	return hooks
+}
+
+// spoofRules drop traffic from the machine's taps unless it carries the
+// lease's MAC and address. IPv6 link-local and unspecified sources are let
+// through for neighbor discovery.
+func spoofRules(leases []*Lease, ipv6 bool) [][]string {
+	var rules [][]string
+	for _, lease := range leases {
+		physdev := []string{"-m", "physdev", "--physdev-in", lease.TapDevice}
+		rules = append(rules, append(append([]string{}, physdev...), "-m", "mac", "!", "--mac-source", lease.MAC, "-j", "DROP"))
+		ip := lease.IP
+		if ipv6 {
+			ip = lease.IP6
+		}
+		if ip != nil {
+			rules = append(rules, append(append([]string{}, physdev...), "-s", ip.String(), "-j", "RETURN"))
+		}
+		if ipv6 {
+			for _, src := range []string{"fe80::/10", "::/128"} {
+				rules = append(rules, append(append([]string{}, physdev...), "-s", src, "-p", "ipv6-icmp", "-j", "RETURN"))
+			}
+		}
+	}
+	return append(rules, []string{"-j", "DROP"})
+}
+
+func dualStack(leases []*Lease) bool {
+	for _, lease := range leases {
+		if lease.IP6 != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the iptables match for the rule. Egress rules match the
+// destination of the traffic, ingress rules its source. ICMP matches
+// ICMPv6 for IPv6 CIDRs.
+func (r PolicyRule) match(direction string) []string {
+	addr := "-d"
+	if direction == "INGRESS" {
+		addr = "-s"
+	}
+	spec := []string{addr, r.CIDR}
+	if proto := r.Protocol; proto != "" {
+		if proto == "icmp" && r.ipv6() {
+			proto = "ipv6-icmp"
+		}
+		spec = append(spec, "-p", proto)
+	}
+	if len(r.Ports) > 0 {
+		ports := make([]string, len(r.Ports))
+		for i, port := range r.Ports {
+			ports[i] = strconv.Itoa(port)
+		}
+		spec = append(spec, "-m", "multiport", "--dports", strings.Join(ports, ","))
+	}
+	return spec
+}
+
+// RemovePolicy removes the machine's policy chains and the FORWARD and
+// INPUT rules jumping to them. It is a no-op for machines without a policy.
+func RemovePolicy(machineID string) error {
+	var errs []error
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		for _, dir := range []string{"EGRESS", "INGRESS", "SPOOF"} {
+			chain := policyChain(machineID, dir)
+			if err := run("sudo", iptables, "-t", "filter", "-n", "-L", chain); err != nil {
+				continue
+			}
+			if dir == "EGRESS" {
+				if err := removeDNSExemptions(iptables, machineID); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			if err := removeJumps(iptables, chain); err != nil {
+				errs = append(errs, err)
+			}
+			if err := run("sudo", iptables, "-t", "filter", "-F", chain); err != nil {
+				errs = append(errs, err)
+			}
+			if err := run("sudo", iptables, "-t", "filter", "-X", chain); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func removeJumps(iptables, chain string) error {
+	return removeRules(iptables, func(fields []string) bool {
+		return fields[len(fields)-1] == chain
+	})
+}
+
+// removeDNSExemptions removes the INPUT rules accepting DNS queries from
+// the machine's taps, which egress policies install.
+func removeDNSExemptions(iptables, machineID string) error {
+	tap := TapDeviceName(machineID, 0)
+	return removeRules(iptables, func(fields []string) bool {
+		if fields[1] != "INPUT" || fields[len(fields)-1] != "ACCEPT" {
+			return false
+		}
+		for i, field := range fields[:len(fields)-1] {
+			if field == "--physdev-in" && (fields[i+1] == tap || strings.HasPrefix(fields[i+1], tap+"-")) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// removeRules deletes the FORWARD and INPUT rules that match, given in
+// iptables -S syntax.
+func removeRules(iptables string, match func(fields []string) bool) error {
+	for _, builtin := range []string{"FORWARD", "INPUT"} {
+		out, err := output("sudo", iptables, "-t", "filter", "-S", builtin)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(out, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || fields[0] != "-A" || !match(fields) {
+				continue
+			}
+			args := append([]string{iptables, "-t", "filter", "-D"}, fields[1:]...)
+			if err := run("sudo", args...); err != nil {
+				return fmt.Errorf("removing rule %s: %w", line, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package network
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPolicyValidate(t *testing.T) {
+	valid := Policy{
+		Egress: PolicyRules{
+			Allow: []PolicyRule{{CIDR: "10.0.0.0/8", Protocol: "tcp", Ports: []int{443}}},
+			Deny:  []PolicyRule{{CIDR: "fd00::/8"}},
+		},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+
+	for _, rule := range []PolicyRule{
+		{CIDR: "10.0.0.1"},
+		{CIDR: "10.0.0.0/8", Protocol: "sctp"},
+		{CIDR: "10.0.0.0/8", Ports: []int{80}},
+		{CIDR: "10.0.0.0/8", Protocol: "tcp", Ports: []int{0}},
+	} {
+		p := Policy{Ingress: PolicyRules{Deny: []PolicyRule{rule}}}
+		if err := p.Validate(); err == nil {
+			t.Errorf("rule %+v should be rejected", rule)
+		}
+	}
+}
+
+func TestPolicyRuleMatch(t *testing.T) {
+	rule := PolicyRule{CIDR: "10.0.0.0/8", Protocol: "tcp", Ports: []int{80, 443}}
+
+	if got := strings.Join(rule.match("EGRESS"), " "); got != "-d 10.0.0.0/8 -p tcp -m multiport --dports 80,443" {
+		t.Errorf("unexpected egress match %q", got)
+	}
+	if got := strings.Join(rule.match("INGRESS"), " "); got != "-s 10.0.0.0/8 -p tcp -m multiport --dports 80,443" {
+		t.Errorf("unexpected ingress match %q", got)
+	}
+
+	icmp := PolicyRule{CIDR: "fd00::/8", Protocol: "icmp"}
+	if got := strings.Join(icmp.match("EGRESS"), " "); got != "-d fd00::/8 -p ipv6-icmp" {
+		t.Errorf("unexpected IPv6 icmp match %q", got)
+	}
+}
+
+func TestPolicyHooks(t *testing.T) {
+	lease := &Lease{
+		Bridge:    "mbr1234",
+		TapDevice: "tapabc",
+		MAC:       "06:00:ac:11:00:02",
+		IP:        net.ParseIP("172.17.0.2"),
+		Gateway:   net.ParseIP("172.17.0.1"),
+	}
+
+	var egress []string
+	for _, hook := range policyHooks(lease, false, "EGRESS", "MACHINE-abc-EGRESS") {
+		egress = append(egress, strings.Join(hook, " "))
+	}
+	want := []string{
+		"-t filter FORWARD -m physdev --physdev-in tapabc ! --physdev-is-bridged -j MACHINE-abc-EGRESS",
+		"-t filter INPUT -m physdev --physdev-in tapabc -j MACHINE-abc-EGRESS",
+		"-t filter INPUT -m physdev --physdev-in tapabc -d 172.17.0.1 -p udp --dport 10053 -j ACCEPT",
+		"-t filter INPUT -m physdev --physdev-in tapabc -d 172.17.0.1 -p tcp --dport 10053 -j ACCEPT",
+	}
+	if strings.Join(egress, "\n") != strings.Join(want, "\n") {
+		t.Errorf("egress hooks:\n%s\nwant:\n%s", strings.Join(egress, "\n"), strings.Join(want, "\n"))
+	}
+	for _, hook := range egress {
+		if strings.Contains(hook, "-s 172.17.0.2") {
+			t.Errorf("egress hook %q matches the spoofable source address", hook)
+		}
+	}
+
+	if hooks := policyHooks(lease, true, "EGRESS", "MACHINE-abc-EGRESS"); hooks != nil {
+		t.Errorf("got IPv6 hooks for a lease without IPv6: %q", hooks)
+	}
+}
+
+func TestSpoofRules(t *testing.T) {
+	lease := &Lease{
+		TapDevice: "tapabc",
+		MAC:       "06:00:ac:11:00:02",
+		IP:        net.ParseIP("172.17.0.2"),
+	}
+
+	var rules []string
+	for _, rule := range spoofRules([]*Lease{lease}, false) {
+		rules = append(rules, strings.Join(rule, " "))
+	}
+	want := []string{
+		"-m physdev --physdev-in tapabc -m mac ! --mac-source 06:00:ac:11:00:02 -j DROP",
+		"-m physdev --physdev-in tapabc -s 172.17.0.2 -j RETURN",
+		"-j DROP",
+	}
+	if strings.Join(rules, "\n") != strings.Join(want, "\n") {
+		t.Errorf("spoof rules:\n%s\nwant:\n%s", strings.Join(rules, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrRouteExists   = errors.New("route already exists")
+	ErrNoRoute       = errors.New("no route")
+	ErrNoSuchMachine = errors.New("machine not found")
+)
+
+// Route sends requests matching Host and PathPrefix to Port on a machine.
+// At least one of Host and PathPrefix is set; an empty one matches
+// anything.
+type Route struct {
+	ID         string `json:"id"`
+	Host       string `json:"host,omitempty"`
+	PathPrefix string `json:"path_prefix,omitempty"`
+	MachineID  string `json:"machine_id"`
+	Port       int    `json:"port"`
+}
+
+// ResolveFunc returns the guest address requests for a machine are sent to.
+// It may block until the machine is ready, for as long as ctx allows.
+type ResolveFunc func(ctx context.Context, machineID string) (net.IP, error)
+
+// Proxy is a reverse proxy routing requests to machines by Host header
+// and path prefix.
+type Proxy struct {
+	Resolve ResolveFunc
+	// Done, if set, is called once a request to a machine that was
+	// successfully resolved has been proxied.
+	Done func(machineID string)
+	// Exists, if set, reports whether a machine can be routed to. Add
+	// checks it while holding the routes lock, so a route can't slip in
+	// after RemoveMachine cleaned up a machine that was just removed.
+	Exists func(machineID string) bool
+
+	mu     sync.RWMutex
+	routes map[string]Route
+}
+
+func New(resolve ResolveFunc) *Proxy {
+	return &Proxy{Resolve: resolve, routes: map[string]Route{}}
+}
+
+func (r Route) Validate() error {
+	if r.ID == "" || r.MachineID == "" {
+		return fmt.Errorf("route needs an id and a machine_id")
+	}
+	if r.Host == "" && r.PathPrefix == "" {
+		return fmt.Errorf("route needs a host or a path_prefix")
+	}
+	if r.PathPrefix != "" && !strings.HasPrefix(r.PathPrefix, "/") {
+		return fmt.Errorf("path_prefix %q must start with /", r.PathPrefix)
+	}
+	if r.Port < 1 || r.Port > 65535 {
+		return fmt.Errorf("invalid port %d", r.Port)
+	}
+	return nil
+}
+
+func (p *Proxy) Add(route Route) (Route, error) {
+	route.Host = normalizeHost(route.Host)
+	if err := route.Validate(); err != nil {
+		return Route{}, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.Exists != nil && !p.Exists(route.MachineID) {
+		return Route{}, fmt.Errorf("%w: %s", ErrNoSuchMachine, route.MachineID)
+	}
+	for _, other := range p.routes {
+		if other.ID == route.ID || (other.Host == route.Host && other.PathPrefix == route.PathPrefix) {
+			return Route{}, fmt.Errorf("%w: %s%s", ErrRouteExists, route.Host, route.PathPrefix)
+		}
+	}
+	if p.routes == nil {
+		p.routes = map[string]Route{}
+	}
+	p.routes[route.ID] = route
+	return route, nil
+}
+
+func (p *Proxy) Remove(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, ok := p.routes[id]
+	delete(p.routes, id)
+	return ok
+}
+
+// RemoveMachine removes all routes to the machine.
+func (p *Proxy) RemoveMachine(machineID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for id, route := range p.routes {
+		if route.MachineID == machineID {
+			delete(p.routes, id)
+		}
+	}
+}
+
+func (p *Proxy) List() []Route {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	list := make([]Route, 0, len(p.routes))
+	for _, route := range p.routes {
+		list = append(list, route)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Match returns the route for the request. Routes with a host win over
+// routes without one, then the longest path prefix wins.
+func (p *Proxy) Match(r *http.Request) (Route, bool) {
+	host := normalizeHost(r.Host)
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var best Route
+	found := false
+	for _, route := range p.routes {
+		if route.Host != "" && route.Host != host {
+			continue
+		}
+		if route.PathPrefix != "" && !hasPathPrefix(r.URL.Path, route.PathPrefix) {
+			continue
+		}
+		if !found || better(route, best) {
+			best, found = route, true
+		}
+	}
+	return best, found
+}
+
+func better(a, b Route) bool {
+	if (a.Host != "") != (b.Host != "") {
+		return a.Host != ""
+	}
+	return len(a.PathPrefix) > len(b.PathPrefix)
+}
+
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route, ok := p.Match(r)
+	if !ok {
+		http.Error(w, ErrNoRoute.Error(), http.StatusNotFound)
+		return
+	}
+
+	ip, err := p.Resolve(r.Context(), route.MachineID)
+	if err != nil {
+		logrus.WithError(err).Warnf("Failed to resolve machine %s for route %s", route.MachineID, route.ID)
+		http.Error(w, "machine unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if p.Done != nil {
+		defer p.Done(route.MachineID)
+	}
+
+	target := &url.URL{Scheme: "http", Host: net.JoinHostPort(ip.String(), strconv.Itoa(route.Port))}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+			pr.Out.Host = pr.In.Host
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logrus.WithError(err).Warnf("Failed to proxy request to machine %s", route.MachineID)
+			http.Error(w, "machine unavailable", http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
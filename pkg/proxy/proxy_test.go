@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	p := New(func(context.Context, string) (net.IP, error) { return nil, errors.New("unused") })
+	for _, route := range []Route{
+		{ID: "any-api", PathPrefix: "/api", MachineID: "m1", Port: 80},
+		{ID: "app", Host: "App.example.com", MachineID: "m2", Port: 80},
+		{ID: "app-api", Host: "app.example.com", PathPrefix: "/api", MachineID: "m3", Port: 80},
+	} {
+		if _, err := p.Add(route); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+
+	for _, tc := range []struct{ url, want string }{
+		{"http://app.example.com:8081/api/v1", "app-api"},
+		{"http://app.example.com/apiary", "app"},
+		{"http://other.example.com/api", "any-api"},
+	} {
+		route, ok := p.Match(httptest.NewRequest("GET", tc.url, nil))
+		if !ok || route.ID != tc.want {
+			t.Errorf("%s matched %q, want %q", tc.url, route.ID, tc.want)
+		}
+	}
+	if _, ok := p.Match(httptest.NewRequest("GET", "http://other.example.com/", nil)); ok {
+		t.Errorf("unrouted request should not match")
+	}
+
+	_, err := p.Add(Route{ID: "dup", Host: "app.example.com", MachineID: "m4", Port: 80})
+	if !errors.Is(err, ErrRouteExists) {
+		t.Errorf("duplicate host should be rejected, got %v", err)
+	}
+}
+
+func TestAddRemovedMachine(t *testing.T) {
+	p := New(func(context.Context, string) (net.IP, error) { return nil, errors.New("unused") })
+	removed := map[string]bool{}
+	p.Exists = func(machineID string) bool { return !removed[machineID] }
+
+	if _, err := p.Add(Route{ID: "app", Host: "app.example.com", MachineID: "m1", Port: 80}); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	removed["m1"] = true
+	p.RemoveMachine("m1")
+
+	_, err := p.Add(Route{ID: "late", Host: "late.example.com", MachineID: "m1", Port: 80})
+	if !errors.Is(err, ErrNoSuchMachine) {
+		t.Errorf("route to a removed machine should be rejected, got %v", err)
+	}
+	if routes := p.List(); len(routes) != 0 {
+		t.Errorf("got routes %+v, want none", routes)
+	}
+}
@@ -0,0 +1,406 @@
+package rootfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+)
+
+// DefaultCacheDir is where pulled images are kept, relative to the
+// server's working directory.
+const DefaultCacheDir = "images"
+
+// Cache is a local image store keyed by manifest digest. It remembers which
+// digest each reference resolved to, keeps the compressed layers and the
+// extracted image tree, so images are only pulled and extracted once.
+//
+// Layout under Dir:
+//
+//	refs.json                    image reference and platform -> manifest digest
+//	layers/                      compressed and uncompressed layers by digest
+//	trees/sha256-<hex>/          extracted image
+//	manifests/sha256-<hex>.json  image manifest
+//	configs/sha256-<hex>.json    image config file
+//	ext4/sha256-<hex>.ext4       base rootfs image machines are cloned from
+type Cache struct {
+	Dir        string
+	Registries RegistryConfig
+
+	mu       sync.Mutex
+	locks    map[string]*sync.Mutex
+	trackers map[string]*tracker
+}
+
+var DefaultCache = NewCache(DefaultCacheDir)
+
+func NewCache(dir string) *Cache {
+	return &Cache{Dir: dir, locks: map[string]*sync.Mutex{}, trackers: map[string]*tracker{}}
+}
+
+// lock serializes work on one key, so concurrent creates of the same image
+// pull it once while different images are pulled in parallel.
+func (c *Cache) lock(key string) func() {
+	c.mu.Lock()
+	l, ok := c.locks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		c.locks[key] = l
+	}
+	c.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// Tree returns the directory holding the extracted image and its manifest
+// digest, pulling and extracting the image if it isn't cached. A tag that
+// was pulled before is not looked up in the registry again. Images in local
+// OCI layouts and docker archives are read every time, but only extracted
+// when their digest changes.
+func (c *Cache) Tree(imageName string, opts PullOptions) (string, v1.Hash, error) {
+	if img, ok, err := localImage(imageName, opts.platform()); ok {
+		if err != nil {
+			return "", v1.Hash{}, err
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			return "", v1.Hash{}, fmt.Errorf("getting image digest: %w", err)
+		}
+		if opts.Progress != nil {
+			defer c.watch(digest, opts.Progress)()
+		}
+		return c.tree(digest, func() (v1.Image, error) { return img, nil })
+	}
+
+	ref, err := c.Registries.parseReference(imageName)
+	if err != nil {
+		return "", v1.Hash{}, err
+	}
+
+	key := refKey(ref, opts.platform())
+	// Only resolving is serialized per reference. Callers waiting for the
+	// same image then wait in tree, where they see the pull's progress.
+	unlock := c.lock(key)
+	digest, img, err := c.resolve(ref, key, opts)
+	unlock()
+	if err != nil {
+		return "", v1.Hash{}, err
+	}
+	if opts.Progress != nil {
+		defer c.watch(digest, opts.Progress)()
+	}
+	return c.tree(digest, func() (v1.Image, error) {
+		if img == nil {
+			if img, err = c.Registries.fetch(ref.Context().Digest(digest.String()), opts); err != nil {
+				return nil, err
+			}
+		}
+		return cache.Image(img, cache.NewFilesystemCache(filepath.Join(c.Dir, "layers"))), nil
+	})
+}
+
+// tree returns the extracted tree for digest, extracting the image
+// returned by fetch and storing its manifest and config file if they aren't
+// cached yet.
+func (c *Cache) tree(digest v1.Hash, fetch func() (v1.Image, error)) (string, v1.Hash, error) {
+	treeDir := c.treeDir(digest)
+	if c.cached(digest) {
+		return treeDir, digest, nil
+	}
+
+	unlock := c.lock(digest.String())
+	defer unlock()
+	if c.cached(digest) {
+		return treeDir, digest, nil
+	}
+
+	img, err := fetch()
+	if err != nil {
+		return "", v1.Hash{}, err
+	}
+	if err := c.writeMetadata(digest, img); err != nil {
+		return "", v1.Hash{}, err
+	}
+	if _, err := os.Stat(treeDir); err == nil {
+		return treeDir, digest, nil
+	}
+
+	// Extract next to the final location and rename, so a tree that
+	// exists is always complete.
+	if err := os.MkdirAll(filepath.Dir(treeDir), 0755); err != nil {
+		return "", v1.Hash{}, fmt.Errorf("creating cache directory: %w", err)
+	}
+	tmpDir, err := os.MkdirTemp(filepath.Dir(treeDir), "tmp-")
+	if err != nil {
+		return "", v1.Hash{}, fmt.Errorf("creating cache directory: %w", err)
+	}
+	t := c.tracker(digest)
+	defer c.releaseTracker(digest)
+	meta, err := extractImage(img, tmpDir, t)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return "", v1.Hash{}, err
+	}
+	// The metadata is stored before the tree is moved in place, so a tree
+	// that exists always has its metadata.
+	if err := os.Remove(MetadataPath(treeDir)); err != nil && !os.IsNotExist(err) {
+		os.RemoveAll(tmpDir)
+		return "", v1.Hash{}, fmt.Errorf("removing tree metadata: %w", err)
+	}
+	if meta != nil {
+		if err := meta.write(treeDir); err != nil {
+			os.RemoveAll(tmpDir)
+			return "", v1.Hash{}, err
+		}
+	}
+	if err := os.Rename(tmpDir, treeDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", v1.Hash{}, fmt.Errorf("storing extracted image: %w", err)
+	}
+	return treeDir, digest, nil
+}
+
+// cached reports whether the tree, manifest and config file of digest are
+// all stored.
+func (c *Cache) cached(digest v1.Hash) bool {
+	for _, path := range []string{c.treeDir(digest), c.manifestPath(digest), c.configPath(digest)} {
+		if _, err := os.Stat(path); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// ConfigFile returns the config file of an image returned by Tree or Ext4.
+func (c *Cache) ConfigFile(digest v1.Hash) (*v1.ConfigFile, error) {
+	f, err := os.Open(c.configPath(digest))
+	if err != nil {
+		return nil, fmt.Errorf("reading image config: %w", err)
+	}
+	defer f.Close()
+
+	config, err := v1.ParseConfigFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading image config: %w", err)
+	}
+	return config, nil
+}
+
+func (c *Cache) writeMetadata(digest v1.Hash, img v1.Image) error {
+	manifest, err := img.RawManifest()
+	if err != nil {
+		return fmt.Errorf("getting image manifest: %w", err)
+	}
+	config, err := img.RawConfigFile()
+	if err != nil {
+		return fmt.Errorf("getting image config: %w", err)
+	}
+	// Images are listed by their manifests, so the config file is
+	// stored first.
+	if err := writeFile(c.configPath(digest), config); err != nil {
+		return fmt.Errorf("storing image config: %w", err)
+	}
+	if err := writeFile(c.manifestPath(digest), manifest); err != nil {
+		return fmt.Errorf("storing image manifest: %w", err)
+	}
+	return nil
+}
+
+// writeFile replaces path atomically, creating its directory if needed.
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// BuildFunc builds an ext4 image at output from the directory tree.
+type BuildFunc func(tree, output string) error
+
+// Ext4 returns the base ext4 image for the image and its manifest digest,
+// building it with build once per digest. Machines must not use the base
+// directly but a CloneFile of it.
+func (c *Cache) Ext4(imageName string, opts PullOptions, build BuildFunc) (string, v1.Hash, error) {
+	for {
+		tree, digest, err := c.Tree(imageName, opts)
+		if err != nil {
+			return "", v1.Hash{}, err
+		}
+		path, ok, err := c.ext4(tree, digest, build)
+		if err != nil {
+			return "", v1.Hash{}, err
+		}
+		if ok {
+			return path, digest, nil
+		}
+		// The image was removed before it was built, pull it again.
+	}
+}
+
+// ext4 builds the base ext4 image from the tree of digest. It holds the
+// locks Remove takes, so the tree can't go away during the build, and
+// reports false if it already had.
+func (c *Cache) ext4(tree string, digest v1.Hash, build BuildFunc) (string, bool, error) {
+	unlock := c.lock(digest.String())
+	defer unlock()
+	unlockExt4 := c.lock("ext4:" + digest.String())
+	defer unlockExt4()
+
+	path := c.ext4Path(digest)
+	if _, err := os.Stat(path); err == nil {
+		return path, true, nil
+	}
+	if !c.cached(digest) {
+		return "", false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", false, fmt.Errorf("creating cache directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := build(tree, tmp); err != nil {
+		os.Remove(tmp)
+		return "", false, fmt.Errorf("building ext4 image: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", false, fmt.Errorf("storing ext4 image: %w", err)
+	}
+	return path, true, nil
+}
+
+// resolve returns the manifest digest for ref on the requested platform.
+// The image is returned too when it had to be fetched from the registry.
+//
+// Pulls with their own credentials always ask the registry, so a cached
+// private image is only handed to callers that can access it.
+func (c *Cache) resolve(ref name.Reference, key string, opts PullOptions) (v1.Hash, v1.Image, error) {
+	// Digests always resolve to the same image.
+	_, pinned := ref.(name.Digest)
+	if opts.Auth == nil && (!opts.Refresh || pinned) {
+		refs, err := c.readRefs()
+		if err != nil {
+			return v1.Hash{}, nil, err
+		}
+		if s, ok := refs[key]; ok {
+			digest, err := v1.NewHash(s)
+			return digest, nil, err
+		}
+	}
+
+	img, err := c.Registries.fetch(ref, opts)
+	if err != nil {
+		return v1.Hash{}, nil, err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return v1.Hash{}, nil, fmt.Errorf("getting image digest: %w", err)
+	}
+	if opts.Auth == nil {
+		if err := c.writeRef(key, digest); err != nil {
+			return v1.Hash{}, nil, err
+		}
+	}
+	return digest, img, nil
+}
+
+// refKey identifies a reference in refs.json. Digests of multi-platform
+// indexes resolve to a different image per platform, so the platform is
+// part of the key.
+func refKey(ref name.Reference, platform v1.Platform) string {
+	return ref.Name() + " " + platform.String()
+}
+
+func (c *Cache) treeDir(digest v1.Hash) string {
+	return filepath.Join(c.Dir, "trees", digest.Algorithm+"-"+digest.Hex)
+}
+
+func (c *Cache) manifestPath(digest v1.Hash) string {
+	return filepath.Join(c.Dir, "manifests", digest.Algorithm+"-"+digest.Hex+".json")
+}
+
+func (c *Cache) configPath(digest v1.Hash) string {
+	return filepath.Join(c.Dir, "configs", digest.Algorithm+"-"+digest.Hex+".json")
+}
+
+func (c *Cache) ext4Path(digest v1.Hash) string {
+	return filepath.Join(c.Dir, "ext4", digest.Algorithm+"-"+digest.Hex+".ext4")
+}
+
+func (c *Cache) refsPath() string {
+	return filepath.Join(c.Dir, "refs.json")
+}
+
+func (c *Cache) readRefs() (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.readRefsLocked()
+}
+
+func (c *Cache) readRefsLocked() (map[string]string, error) {
+	refs := map[string]string{}
+	data, err := os.ReadFile(c.refsPath())
+	if os.IsNotExist(err) {
+		return refs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading image refs: %w", err)
+	}
+	if err := json.Unmarshal(data, &refs); err != nil {
+		return nil, fmt.Errorf("reading image refs: %w", err)
+	}
+	return refs, nil
+}
+
+func (c *Cache) writeRef(ref string, digest v1.Hash) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	refs, err := c.readRefsLocked()
+	if err != nil {
+		return err
+	}
+	refs[ref] = digest.String()
+	return c.writeRefsLocked(refs)
+}
+
+func (c *Cache) writeRefsLocked(refs map[string]string) error {
+	data, err := json.MarshalIndent(refs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("writing image refs: %w", err)
+	}
+	if err := writeFile(c.refsPath(), data); err != nil {
+		return fmt.Errorf("writing image refs: %w", err)
+	}
+	return nil
+}
+
+// copyTree copies an extracted image, preserving everything extraction
+// set up, and shares data blocks where the file system supports it.
+func copyTree(src, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return fmt.Errorf("creating directory: %w", err)
+	}
+	out, err := exec.Command("cp", "-a", "--reflink=auto", src+"/.", dst+"/").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("copying image: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package rootfs
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestCacheTree(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatalf("creating image: %v", err)
+	}
+	imageName := fmt.Sprintf("%s/test/image:latest", strings.TrimPrefix(server.URL, "http://"))
+	ref, err := name.ParseReference(imageName)
+	if err != nil {
+		t.Fatalf("parsing reference: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("pushing image: %v", err)
+	}
+	want, err := img.Digest()
+	if err != nil {
+		t.Fatalf("getting digest: %v", err)
+	}
+
+	c := NewCache(t.TempDir())
+	tree, digest, err := c.Tree(imageName, PullOptions{})
+	if err != nil {
+		t.Fatalf("Tree failed: %v", err)
+	}
+	if digest != want {
+		t.Errorf("digest = %s, want %s", digest, want)
+	}
+	entries, err := os.ReadDir(tree)
+	if err != nil || len(entries) == 0 {
+		t.Fatalf("extracted tree is empty: %v", err)
+	}
+
+	// A cached image doesn't need the registry anymore.
+	server.Close()
+	again, _, err := c.Tree(imageName, PullOptions{})
+	if err != nil {
+		t.Fatalf("Tree without registry failed: %v", err)
+	}
+	if again != tree {
+		t.Errorf("got tree %s, want %s", again, tree)
+	}
+}
+
+func TestCacheConfigFile(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("creating image: %v", err)
+	}
+	img, err = mutate.Config(img, v1.Config{
+		Entrypoint: []string{"/docker-entrypoint.sh"},
+		Cmd:        []string{"nginx", "-g", "daemon off;"},
+		Env:        []string{"PATH=/usr/bin:/bin", "NGINX_VERSION=1.27"},
+		WorkingDir: "/srv",
+		User:       "nginx",
+	})
+	if err != nil {
+		t.Fatalf("setting config: %v", err)
+	}
+	imageName := fmt.Sprintf("%s/test/image:latest", strings.TrimPrefix(server.URL, "http://"))
+	ref, err := name.ParseReference(imageName)
+	if err != nil {
+		t.Fatalf("parsing reference: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("pushing image: %v", err)
+	}
+
+	c := NewCache(t.TempDir())
+	_, digest, err := c.Tree(imageName, PullOptions{})
+	if err != nil {
+		t.Fatalf("Tree failed: %v", err)
+	}
+	config, err := c.ConfigFile(digest)
+	if err != nil {
+		t.Fatalf("ConfigFile failed: %v", err)
+	}
+	if got := config.Config.Entrypoint; len(got) != 1 || got[0] != "/docker-entrypoint.sh" {
+		t.Errorf("Entrypoint = %q", got)
+	}
+	if got := config.Config.Cmd; len(got) != 3 || got[0] != "nginx" {
+		t.Errorf("Cmd = %q", got)
+	}
+	if config.Config.WorkingDir != "/srv" || config.Config.User != "nginx" {
+		t.Errorf("WorkingDir, User = %q, %q", config.Config.WorkingDir, config.Config.User)
+	}
+
+	// Trees cached before config files were stored get one on the next
+	// pull.
+	if err := os.Remove(c.configPath(digest)); err != nil {
+		t.Fatalf("removing config: %v", err)
+	}
+	if _, _, err := c.Tree(imageName, PullOptions{}); err != nil {
+		t.Fatalf("Tree failed: %v", err)
+	}
+	if _, err := c.ConfigFile(digest); err != nil {
+		t.Errorf("ConfigFile after repull failed: %v", err)
+	}
+}
+
+func TestCacheTreePlatform(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("creating image: %v", err)
+	}
+	idx := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add:        img,
+		Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+	})
+	imageName := fmt.Sprintf("%s/test/multi:latest", strings.TrimPrefix(server.URL, "http://"))
+	ref, err := name.ParseReference(imageName)
+	if err != nil {
+		t.Fatalf("parsing reference: %v", err)
+	}
+	if err := remote.WriteIndex(ref, idx); err != nil {
+		t.Fatalf("pushing index: %v", err)
+	}
+
+	c := NewCache(t.TempDir())
+	_, _, err = c.Tree(imageName, PullOptions{Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}})
+	if !errors.Is(err, ErrPlatformNotFound) {
+		t.Errorf("got %v, want ErrPlatformNotFound", err)
+	}
+
+	_, digest, err := c.Tree(imageName, PullOptions{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}})
+	if err != nil {
+		t.Fatalf("Tree failed: %v", err)
+	}
+	if want, _ := img.Digest(); digest != want {
+		t.Errorf("digest = %s, want the amd64 image %s", digest, want)
+	}
+}
+
+func TestCacheTreeLocalImages(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("creating image: %v", err)
+	}
+	want, err := img.Digest()
+	if err != nil {
+		t.Fatalf("getting digest: %v", err)
+	}
+	dir := t.TempDir()
+
+	layoutPath := filepath.Join(dir, "layout")
+	p, err := layout.Write(layoutPath, empty.Index)
+	if err != nil {
+		t.Fatalf("writing layout: %v", err)
+	}
+	if err := p.AppendImage(img, layout.WithAnnotations(map[string]string{ociRefNameAnnotation: "v1"})); err != nil {
+		t.Fatalf("appending image: %v", err)
+	}
+
+	tag, err := name.NewTag("example.com/test/image:v1")
+	if err != nil {
+		t.Fatalf("parsing tag: %v", err)
+	}
+	archivePath := filepath.Join(dir, "image.tar")
+	if err := tarball.WriteToFile(archivePath, tag, img); err != nil {
+		t.Fatalf("writing archive: %v", err)
+	}
+
+	c := NewCache(t.TempDir())
+	for _, imageName := range []string{
+		"oci-layout:" + layoutPath + ":v1",
+		"oci-layout:" + layoutPath,
+		"docker-archive:" + archivePath,
+	} {
+		_, digest, err := c.Tree(imageName, PullOptions{})
+		if err != nil {
+			t.Errorf("%s: Tree failed: %v", imageName, err)
+			continue
+		}
+		if digest != want {
+			t.Errorf("%s: digest = %s, want %s", imageName, digest, want)
+		}
+	}
+
+	if _, _, err := c.Tree("oci-layout:"+layoutPath+":v2", PullOptions{}); err == nil {
+		t.Errorf("missing tag should fail")
+	}
+}
+
+func TestCacheTreeWithAuthSkipsRefs(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("creating image: %v", err)
+	}
+	imageName := fmt.Sprintf("%s/test/private:latest", strings.TrimPrefix(server.URL, "http://"))
+	ref, err := name.ParseReference(imageName)
+	if err != nil {
+		t.Fatalf("parsing reference: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("pushing image: %v", err)
+	}
+
+	c := NewCache(t.TempDir())
+	if _, _, err := c.Tree(imageName, PullOptions{Auth: authn.Anonymous}); err != nil {
+		t.Fatalf("Tree failed: %v", err)
+	}
+	refs, err := c.readRefs()
+	if err != nil {
+		t.Fatalf("reading refs: %v", err)
+	}
+	if len(refs) != 0 {
+		t.Errorf("pull with credentials was recorded in refs: %v", refs)
+	}
+}
+
+func TestCacheTreeRefresh(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	imageName := fmt.Sprintf("%s/test/image:latest", strings.TrimPrefix(server.URL, "http://"))
+	ref, err := name.ParseReference(imageName)
+	if err != nil {
+		t.Fatalf("parsing reference: %v", err)
+	}
+
+	push := func() v1.Hash {
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatalf("creating image: %v", err)
+		}
+		if err := remote.Write(ref, img); err != nil {
+			t.Fatalf("pushing image: %v", err)
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			t.Fatalf("getting digest: %v", err)
+		}
+		return digest
+	}
+
+	c := NewCache(t.TempDir())
+	first := push()
+	if _, digest, err := c.Tree(imageName, PullOptions{}); err != nil || digest != first {
+		t.Fatalf("Tree = %s, %v, want %s", digest, err, first)
+	}
+
+	// The tag is moved to another image.
+	second := push()
+	if _, digest, err := c.Tree(imageName, PullOptions{}); err != nil || digest != first {
+		t.Errorf("Tree without refresh = %s, %v, want the cached %s", digest, err, first)
+	}
+	if _, digest, err := c.Tree(imageName, PullOptions{Refresh: true}); err != nil || digest != second {
+		t.Errorf("Tree with refresh = %s, %v, want %s", digest, err, second)
+	}
+	if _, digest, err := c.Tree(imageName, PullOptions{}); err != nil || digest != second {
+		t.Errorf("Tree after refresh = %s, %v, want %s", digest, err, second)
+	}
+}
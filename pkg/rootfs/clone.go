@@ -0,0 +1,72 @@
+package rootfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneChunk is the granularity at which CloneFile detects holes when it
+// has to copy.
+const cloneChunk = 64 << 10
+
+// CloneFile copies src to dst as a copy-on-write reflink where the file
+// system supports it (btrfs, xfs), and as a sparse copy otherwise, so
+// unused blocks of an image take no space either way.
+func CloneFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("opening source: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("creating destination: %w", err)
+	}
+	defer out.Close()
+
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err == nil {
+		return nil
+	}
+
+	if err := sparseCopy(out, in); err != nil {
+		return fmt.Errorf("copying %s: %w", src, err)
+	}
+	return out.Close()
+}
+
+// sparseCopy copies in to out, seeking over zeroed chunks instead of
+// writing them.
+func sparseCopy(out, in *os.File) error {
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, cloneChunk)
+	zero := make([]byte, cloneChunk)
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			if bytes.Equal(buf[:n], zero[:n]) {
+				if _, err := out.Seek(int64(n), io.SeekCurrent); err != nil {
+					return err
+				}
+			} else if _, err := out.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Trailing holes are only recorded by the file size.
+	return out.Truncate(fi.Size())
+}
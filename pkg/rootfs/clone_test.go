@@ -0,0 +1,32 @@
+package rootfs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCloneFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "base.ext4")
+
+	data := make([]byte, 1<<20)
+	copy(data[4096:], "superblock")
+	copy(data[len(data)-5:], "tail!")
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatalf("writing source: %v", err)
+	}
+
+	dst := filepath.Join(dir, "rootfs.ext4")
+	if err := CloneFile(src, dst); err != nil {
+		t.Fatalf("CloneFile failed: %v", err)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("reading clone: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("clone differs from source")
+	}
+}
@@ -1,16 +1,60 @@
 package rootfs
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io/fs"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
 )
 
-func CreateExt4Image(inputDir, outputImage string, sizeMB int) error {
+// BuildMethod selects how CreateExt4Image puts the input tree into the
+// image.
+type BuildMethod string
+
+const (
+	// BuildMkfs populates the file system while formatting it with
+	// mkfs.ext4 -d. It needs no privileges.
+	BuildMkfs BuildMethod = "mkfs"
+	// BuildMount formats an empty file system, mounts it and copies the
+	// tree in. It needs sudo for mount and cp.
+	BuildMount BuildMethod = "mount"
+)
+
+// CreateExt4Image builds an ext4 image of sizeMB from inputDir. A size of 0
+// sizes the image from its content with DefaultHeadroomMB of free space.
+// The Metadata recorded for inputDir, if any, is applied to the image.
+func CreateExt4Image(inputDir, outputImage string, sizeMB int, method BuildMethod) error {
+	if method != BuildMkfs && method != BuildMount {
+		return fmt.Errorf("unknown build method %q", method)
+	}
+
+	if sizeMB == 0 {
+		var err error
+		if sizeMB, err = ImageSizeMB(inputDir, DefaultHeadroomMB); err != nil {
+			return err
+		}
+	}
+
 	if err := createEmptyFile(outputImage, sizeMB); err != nil {
 		return fmt.Errorf("creating empty file: %w", err)
 	}
 
+	if method == BuildMkfs {
+		// Files keep their owners from the tree, the root directory would
+		// otherwise belong to whoever runs mkfs.
+		if err := formatExt4(outputImage, "-d", inputDir, "-E", "root_owner=0:0"); err != nil {
+			return fmt.Errorf("formatting ext4: %w", err)
+		}
+		return applyTreeMetadata(inputDir, outputImage)
+	}
+
 	if err := formatExt4(outputImage); err != nil {
 		return fmt.Errorf("formatting ext4: %w", err)
 	}
@@ -34,17 +78,150 @@ func CreateExt4Image(inputDir, outputImage string, sizeMB int) error {
 		return fmt.Errorf("unmounting image: %w", err)
 	}
 
+	return applyTreeMetadata(inputDir, outputImage)
+}
+
+// applyTreeMetadata sets the ownership, modes and xattrs recorded for the
+// tree on the files in the image and creates its device nodes, using
+// debugfs on the unmounted image. Files the metadata doesn't list belong to
+// root. Trees extracted as root have no metadata and are left alone.
+func applyTreeMetadata(tree, image string) error {
+	meta, err := ReadMetadata(tree)
+	if err != nil || meta == nil {
+		return err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "ext4-metadata-*")
+	if err != nil {
+		return fmt.Errorf("creating temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var cmds bytes.Buffer
+	err = filepath.WalkDir(tree, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		key := metadataKey(tree, p)
+		if _, ok := meta[key]; ok {
+			return nil
+		}
+		q, err := debugfsQuote(key)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&cmds, "sif %s uid 0\nsif %s gid 0\n", q, q)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("listing tree: %w", err)
+	}
+
+	// Parents sort before their children, so they exist when device
+	// nodes are created in them.
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		md := meta[key]
+		q, err := debugfsQuote(key)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(filepath.Join(tree, filepath.FromSlash(key))); md.device() && os.IsNotExist(err) {
+			// Parts of a quotable key are quotable.
+			dir, base := path.Split(key)
+			qdir, _ := debugfsQuote(dir)
+			qbase, _ := debugfsQuote(base)
+			kind := "c"
+			if md.Mode&syscall.S_IFMT == syscall.S_IFBLK {
+				kind = "b"
+			}
+			fmt.Fprintf(&cmds, "cd %s\nmknod %s %s %d %d\ncd /\n", qdir, qbase, kind, md.Major, md.Minor)
+		}
+		fmt.Fprintf(&cmds, "sif %s uid %d\nsif %s gid %d\nsif %s mode 0%o\n", q, md.UID, q, md.GID, q, md.Mode)
+
+		names := make([]string, 0, len(md.Xattrs))
+		for name := range md.Xattrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			// Values are binary, debugfs reads them from a file.
+			valuePath := filepath.Join(tmpDir, fmt.Sprintf("xattr-%d", cmds.Len()))
+			if err := os.WriteFile(valuePath, []byte(md.Xattrs[name]), 0600); err != nil {
+				return fmt.Errorf("writing xattr value: %w", err)
+			}
+			qname, err := debugfsQuote(name)
+			if err != nil {
+				return err
+			}
+			qvalue, err := debugfsQuote(valuePath)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(&cmds, "ea_set -f %s %s %s\n", qvalue, q, qname)
+		}
+	}
+
+	cmdsPath := filepath.Join(tmpDir, "commands")
+	if err := os.WriteFile(cmdsPath, cmds.Bytes(), 0600); err != nil {
+		return fmt.Errorf("writing debugfs commands: %w", err)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("debugfs", "-w", "-f", cmdsPath, image)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("applying tree metadata: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	// debugfs exits 0 when commands fail, and reports them after its
+	// version banner.
+	var failures []string
+	scanner := bufio.NewScanner(&stderr)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "debugfs ") {
+			failures = append(failures, line)
+		}
+	}
+	if len(failures) > 5 {
+		failures = append(failures[:5], fmt.Sprintf("and %d more", len(failures)-5))
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("applying tree metadata: %s", strings.Join(failures, "; "))
+	}
 	return nil
 }
 
+// debugfsQuote quotes s as an argument of a debugfs command.
+func debugfsQuote(s string) (string, error) {
+	if strings.ContainsAny(s, "\n\x00") {
+		return "", fmt.Errorf("%q can't be passed to debugfs", s)
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`, nil
+}
+
+// createEmptyFile creates a sparse file of sizeMB. Blocks are only
+// allocated once the file system writes to them.
 func createEmptyFile(path string, sizeMB int) error {
-	cmd := exec.Command("dd", "if=/dev/zero", "of="+path, fmt.Sprintf("bs=%dM", sizeMB), "count=1")
-	return cmd.Run()
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(int64(sizeMB) << 20); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
 }
 
-func formatExt4(imagePath string) error {
-	cmd := exec.Command("mkfs.ext4", imagePath)
-	return cmd.Run()
+func formatExt4(imagePath string, args ...string) error {
+	cmd := exec.Command("mkfs.ext4", append(args, imagePath)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
 }
 
 func mountImage(imagePath, mountPoint string) error {
@@ -61,3 +238,24 @@ func copyContents(src, dst string) error {
 	cmd := exec.Command("sudo", "cp", "-a", src+"/.", dst+"/")
 	return cmd.Run()
 }
+
+// DiskUsage is the size of a file as seen by the guest (apparent) and the
+// blocks allocated to it on the host (allocated), which is less for sparse
+// files. Extents a reflink clone shares with its source count in full.
+type DiskUsage struct {
+	ApparentBytes  int64 `json:"apparent_bytes"`
+	AllocatedBytes int64 `json:"allocated_bytes"`
+}
+
+func FileDiskUsage(path string) (DiskUsage, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return DiskUsage{}, err
+	}
+	usage := DiskUsage{ApparentBytes: info.Size()}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		// st_blocks is always in 512 byte units.
+		usage.AllocatedBytes = st.Blocks * 512
+	}
+	return usage, nil
+}
@@ -0,0 +1,91 @@
+package rootfs
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// debugfsStat returns debugfs' description of the inode at path in image.
+func debugfsStat(t *testing.T, image, path string) string {
+	t.Helper()
+	out, err := exec.Command("debugfs", "-R", "stat "+path, image).Output()
+	if err != nil {
+		t.Fatalf("debugfs stat %s: %v", path, err)
+	}
+	return string(out)
+}
+
+var ownerPattern = regexp.MustCompile(`User:\s+(\d+)\s+Group:\s+(\d+)`)
+
+func TestCreateExt4ImageMetadata(t *testing.T) {
+	for _, tool := range []string{"mkfs.ext4", "debugfs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not installed", tool)
+		}
+	}
+
+	// An unprivileged extraction leaves the files owned by the server's
+	// user and records what the layers wanted.
+	tree := filepath.Join(t.TempDir(), "tree")
+	for _, dir := range []string{"etc", "dev", "home/app data"} {
+		if err := os.MkdirAll(filepath.Join(tree, dir), 0755); err != nil {
+			t.Fatalf("creating directory: %v", err)
+		}
+	}
+	for _, file := range []string{"etc/passwd", "home/app data/ping"} {
+		if err := os.WriteFile(filepath.Join(tree, file), []byte("x"), 0644); err != nil {
+			t.Fatalf("writing file: %v", err)
+		}
+	}
+	if err := os.Symlink("ping", filepath.Join(tree, "home/app data/link")); err != nil {
+		t.Fatalf("creating symlink: %v", err)
+	}
+	if os.Geteuid() == 0 {
+		filepath.Walk(tree, func(path string, _ os.FileInfo, _ error) error {
+			return os.Lchown(path, 4242, 4242)
+		})
+	}
+	meta := Metadata{
+		"/home/app data":      {UID: 1000, GID: 1000, Mode: 040750},
+		"/home/app data/ping": {UID: 1000, GID: 1001, Mode: 0104755, Xattrs: map[string]string{"trusted.test": "y\x00z"}},
+		"/home/app data/link": {UID: 1000, GID: 1000, Mode: 0120777},
+		"/dev/null":           {Mode: 020666, Major: 1, Minor: 3},
+	}
+	if err := meta.write(tree); err != nil {
+		t.Fatalf("writing metadata: %v", err)
+	}
+
+	image := filepath.Join(t.TempDir(), "rootfs.ext4")
+	if err := CreateExt4Image(tree, image, 16, BuildMkfs); err != nil {
+		t.Fatalf("CreateExt4Image failed: %v", err)
+	}
+
+	for path, want := range map[string][2]string{
+		"/":                     {"0", "0"},
+		"/etc/passwd":           {"0", "0"},
+		`"/home/app data"`:      {"1000", "1000"},
+		`"/home/app data/ping"`: {"1000", "1001"},
+		`"/home/app data/link"`: {"1000", "1000"},
+		"/dev/null":             {"0", "0"},
+	} {
+		m := ownerPattern.FindStringSubmatch(debugfsStat(t, image, path))
+		if m == nil || m[1] != want[0] || m[2] != want[1] {
+			t.Errorf("%s owned by %v, want %s:%s", path, m, want[0], want[1])
+		}
+	}
+
+	ping := debugfsStat(t, image, `"/home/app data/ping"`)
+	if !strings.Contains(ping, "Mode:  04755") {
+		t.Errorf("ping lost its setuid bit:\n%s", ping)
+	}
+	if !strings.Contains(ping, "trusted.test (3)") {
+		t.Errorf("ping lost its xattr:\n%s", ping)
+	}
+	if null := debugfsStat(t, image, "/dev/null"); !strings.Contains(null, "Type: character special") {
+		t.Errorf("/dev/null isn't a device node:\n%s", null)
+	}
+}
@@ -2,17 +2,71 @@ package rootfs
 
 import (
 	"archive/tar"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
-	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/name"
-	"github.com/google/go-containerregistry/pkg/v1/remote"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
-func extractLayerToRootFS(layer io.ReadCloser, outputDir string) error {
+// OCI whiteout markers. A ".wh.<name>" entry deletes <name> from the lower
+// layers, a ".wh..wh..opq" entry hides everything the lower layers put in
+// its directory.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// xattrPAXPrefix prefixes extended attributes in PAX headers.
+const xattrPAXPrefix = "SCHILY.xattr."
+
+var ErrLimitExceeded = errors.New("image exceeds extraction limits")
+
+// Limits bound what extracting an image may write to the host. Zero means
+// unlimited.
+type Limits struct {
+	// MaxBytes is the total size of the regular files in all layers.
+	MaxBytes int64
+	// MaxEntries is the number of tar entries in all layers.
+	MaxEntries int
+}
+
+var DefaultLimits = Limits{MaxBytes: 32 << 30, MaxEntries: 1 << 20}
+
+// usage tracks what has been extracted from an image against its limits.
+type usage struct {
+	limits  Limits
+	bytes   int64
+	entries int
+}
+
+func (u *usage) add(header *tar.Header) error {
+	u.entries++
+	if u.limits.MaxEntries > 0 && u.entries > u.limits.MaxEntries {
+		return fmt.Errorf("%w: more than %d entries", ErrLimitExceeded, u.limits.MaxEntries)
+	}
+	if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+		u.bytes += header.Size
+		if u.limits.MaxBytes > 0 && u.bytes > u.limits.MaxBytes {
+			return fmt.Errorf("%w: more than %d bytes", ErrLimitExceeded, u.limits.MaxBytes)
+		}
+	}
+	return nil
+}
+
+// extractLayerToRootFS applies a layer to outputDir. If meta is not nil, the
+// metadata of every entry is recorded in it too.
+func extractLayerToRootFS(layer io.ReadCloser, outputDir string, u *usage, meta Metadata) error {
+	// extracted holds the paths written by this layer, which an opaque
+	// whiteout must leave alone.
+	extracted := map[string]bool{}
+	var dirs []dirEntry
+
 	tr := tar.NewReader(layer)
 	for {
 		header, err := tr.Next()
@@ -23,77 +77,306 @@ func extractLayerToRootFS(layer io.ReadCloser, outputDir string) error {
 			return fmt.Errorf("reading tar: %w", err)
 		}
 
-		path := filepath.Join(outputDir, header.Name)
-		switch header.Typeflag {
-		case tar.TypeDir:
-			if err := os.MkdirAll(path, 0755); err != nil {
-				return fmt.Errorf("creating directory: %w", err)
+		if err := u.add(header); err != nil {
+			return err
+		}
+		path, err := securePath(outputDir, header.Name)
+		if err != nil {
+			return err
+		}
+		base := filepath.Base(path)
+		if base == whiteoutOpaque {
+			if err := removeLowerEntries(filepath.Dir(path), extracted); err != nil {
+				return fmt.Errorf("applying opaque whiteout %s: %w", header.Name, err)
 			}
-		case tar.TypeReg:
-			dir := filepath.Dir(path)
-			if err := os.MkdirAll(dir, 0755); err != nil {
-				return fmt.Errorf("creating directory: %w", err)
+			if meta != nil {
+				meta.removeLower(outputDir, filepath.Dir(path), extracted)
 			}
-			file, err := os.Create(path)
-			if err != nil {
-				return fmt.Errorf("creating file: %w", err)
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			deleted := strings.TrimPrefix(base, whiteoutPrefix)
+			if deleted == "" || deleted == "." || deleted == ".." {
+				return fmt.Errorf("%w: whiteout %q", ErrUnsafePath, header.Name)
 			}
-			if _, err := io.Copy(file, tr); err != nil {
-				file.Close()
-				return fmt.Errorf("writing file: %w", err)
+			target := filepath.Join(filepath.Dir(path), deleted)
+			if err := os.RemoveAll(target); err != nil {
+				return fmt.Errorf("applying whiteout %s: %w", header.Name, err)
 			}
-			file.Close()
-			
-			if err := os.Chmod(path, os.FileMode(header.Mode)); err != nil {
-				return fmt.Errorf("setting file permissions: %w", err)
+			if meta != nil {
+				meta.remove(metadataKey(outputDir, target))
 			}
-		case tar.TypeSymlink:
-			dir := filepath.Dir(path)
-			if err := os.MkdirAll(dir, 0755); err != nil {
-				return fmt.Errorf("creating parent directory for symlink: %w", err)
+			continue
+		}
+		extracted[path] = true
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("creating parent directory for %s: %w", header.Name, err)
+		}
+		if err := extractEntry(tr, header, path, outputDir); err != nil {
+			return fmt.Errorf("extracting %s: %w", header.Name, err)
+		}
+		if meta != nil {
+			var target string
+			if header.Typeflag == tar.TypeLink {
+				// extractEntry checked the link target.
+				linkPath, _ := securePath(outputDir, header.Linkname)
+				target = metadataKey(outputDir, linkPath)
 			}
-			
-			if _, err := os.Lstat(path); err == nil {
-				if err := os.Remove(path); err != nil {
-					return fmt.Errorf("removing existing file before creating symlink: %w", err)
-				}
+			meta.record(metadataKey(outputDir, path), header, target)
+		}
+		if header.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirEntry{path, header})
+		}
+	}
+
+	// Creating entries inside a directory changes its mtime, so directory
+	// metadata is applied last, innermost first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		// A later entry may have replaced the directory, possibly with a
+		// symlink that must not be followed.
+		if fi, err := os.Lstat(dirs[i].path); err != nil || !fi.IsDir() {
+			continue
+		}
+		if err := applyMetadata(dirs[i].path, dirs[i].header); err != nil {
+			return fmt.Errorf("extracting %s: %w", dirs[i].header.Name, err)
+		}
+	}
+	return nil
+}
+
+type dirEntry struct {
+	path   string
+	header *tar.Header
+}
+
+// extractEntry creates the file system object for a tar entry, replacing
+// whatever a lower layer left at the path. Regular files, hardlinks,
+// device nodes and FIFOs get their metadata applied right away.
+func extractEntry(tr *tar.Reader, header *tar.Header, path, outputDir string) error {
+	if header.Typeflag == tar.TypeDir {
+		if fi, err := os.Lstat(path); err == nil && !fi.IsDir() {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("removing existing file: %w", err)
+			}
+		}
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return fmt.Errorf("creating directory: %w", err)
+		}
+		return nil
+	}
+
+	// Never write through an existing file: it may be a symlink or share
+	// its inode with a hardlink.
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.IsDir() {
+			err = os.RemoveAll(path)
+		} else {
+			err = os.Remove(path)
+		}
+		if err != nil {
+			return fmt.Errorf("removing existing file: %w", err)
+		}
+	}
+
+	mode := uint32(header.FileInfo().Mode().Perm())
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("creating file: %w", err)
+		}
+		if _, err := io.Copy(file, tr); err != nil {
+			file.Close()
+			return fmt.Errorf("writing file: %w", err)
+		}
+		if err := file.Close(); err != nil {
+			return fmt.Errorf("writing file: %w", err)
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(header.Linkname, path); err != nil {
+			return fmt.Errorf("creating symlink to %s: %w", header.Linkname, err)
+		}
+	case tar.TypeLink:
+		// The link target is already in place with its metadata.
+		target, err := securePath(outputDir, header.Linkname)
+		if err != nil {
+			return err
+		}
+		if err := os.Link(target, path); err != nil {
+			return fmt.Errorf("creating hardlink to %s: %w", header.Linkname, err)
+		}
+		return nil
+	case tar.TypeChar, tar.TypeBlock:
+		kind := uint32(unix.S_IFCHR)
+		if header.Typeflag == tar.TypeBlock {
+			kind = unix.S_IFBLK
+		}
+		dev := unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
+		if err := unix.Mknod(path, kind|mode, int(dev)); err != nil {
+			if !isRoot() {
+				// The node is recorded in the tree's metadata and created
+				// when the ext4 image is built.
+				logrus.Debugf("Skipping device node %s: creating device nodes requires root", header.Name)
+				return nil
 			}
-			
-			if err := os.Symlink(header.Linkname, path); err != nil {
-				return fmt.Errorf("creating symlink %s -> %s: %w", path, header.Linkname, err)
+			return fmt.Errorf("creating device node: %w", err)
+		}
+	case tar.TypeFifo:
+		if err := unix.Mkfifo(path, mode); err != nil {
+			return fmt.Errorf("creating fifo: %w", err)
+		}
+	default:
+		// Other entry types (e.g. sockets or vendor extensions) have no
+		// place in a rootfs.
+		return nil
+	}
+	return applyMetadata(path, header)
+}
+
+// applyMetadata sets the ownership, mode, xattrs and mtime recorded in
+// the tar header. Ownership and privileged xattrs can only be applied when
+// running as root; without root, extractImage records them in the tree's
+// Metadata instead.
+func applyMetadata(path string, header *tar.Header) error {
+	symlink := header.Typeflag == tar.TypeSymlink
+
+	if isRoot() {
+		if err := os.Lchown(path, header.Uid, header.Gid); err != nil {
+			return fmt.Errorf("setting ownership: %w", err)
+		}
+	}
+
+	// Chown clears setuid and setgid bits, so the mode comes after it.
+	// Symlink permissions are meaningless on Linux.
+	if !symlink {
+		if err := os.Chmod(path, header.FileInfo().Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return fmt.Errorf("setting permissions: %w", err)
+		}
+	}
+
+	for key, value := range header.PAXRecords {
+		attr, ok := strings.CutPrefix(key, xattrPAXPrefix)
+		if !ok {
+			continue
+		}
+		if err := unix.Lsetxattr(path, attr, []byte(value), 0); err != nil {
+			if errors.Is(err, unix.ENOTSUP) || (!isRoot() && errors.Is(err, unix.EPERM)) {
+				continue
 			}
+			return fmt.Errorf("setting xattr %s: %w", attr, err)
 		}
 	}
+
+	if header.ModTime.IsZero() {
+		return nil
+	}
+	mtime := unix.NsecToTimespec(header.ModTime.UnixNano())
+	times := []unix.Timespec{mtime, mtime}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return fmt.Errorf("setting mtime: %w", err)
+	}
 	return nil
 }
 
-func ExtractFromImage(imageName, outputDir string) error {
-	ref, err := name.ParseReference(imageName)
+// isRoot reports whether extraction can apply ownership. Tests replace it.
+var isRoot = func() bool {
+	return os.Geteuid() == 0
+}
+
+// removeLowerEntries removes everything in dir that wasn't extracted from
+// the current layer.
+func removeLowerEntries(dir string, extracted map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("parsing reference: %w", err)
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if !extracted[path] {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			continue
+		}
+		if entry.IsDir() {
+			if err := removeLowerEntries(path, extracted); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	img, err := remote.Image(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+// ExtractFromImage writes the image's root filesystem to outputDir. The
+// image is pulled and extracted through DefaultCache, so it is only fetched
+// from the registry the first time. It returns the image's config file.
+// The tree's Metadata, if any, is copied next to outputDir.
+func ExtractFromImage(imageName, outputDir string, opts PullOptions) (*v1.ConfigFile, error) {
+	tree, digest, err := DefaultCache.Tree(imageName, opts)
+	if err != nil {
+		return nil, err
+	}
+	config, err := DefaultCache.ConfigFile(digest)
+	if err != nil {
+		return nil, err
+	}
+	if err := copyTree(tree, outputDir); err != nil {
+		return nil, err
+	}
+	meta, err := ReadMetadata(tree)
 	if err != nil {
-		return fmt.Errorf("getting image: %w", err)
+		return nil, err
+	}
+	if meta != nil {
+		if err := meta.write(outputDir); err != nil {
+			return nil, err
+		}
 	}
+	return config, nil
+}
 
+// extractImage applies the image's layers in order to outputDir. Without
+// root, it returns the metadata it couldn't apply to the tree.
+func extractImage(img v1.Image, outputDir string, t *tracker) (Metadata, error) {
 	layers, err := img.Layers()
 	if err != nil {
-		return fmt.Errorf("getting layers: %w", err)
+		return nil, fmt.Errorf("getting layers: %w", err)
+	}
+	if err := t.start(layers); err != nil {
+		return nil, err
 	}
 
-	for _, layer := range layers {
-		rc, err := layer.Uncompressed()
+	var meta Metadata
+	if !isRoot() {
+		meta = Metadata{}
+	}
+
+	u := &usage{limits: DefaultLimits}
+	for i, layer := range layers {
+		rc, err := uncompressedLayer(layer, func(n int64) { t.add(i, n) })
 		if err != nil {
-			return fmt.Errorf("getting layer: %w", err)
+			return nil, fmt.Errorf("getting layer: %w", err)
+		}
+		if err := extractLayerToRootFS(rc, outputDir, u, meta); err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("extracting layer: %w", err)
 		}
-		if err := extractLayerToRootFS(rc, outputDir); err != nil {
+		// Read past the end of the archive, so the layer is cached in
+		// full and its progress completes.
+		if _, err := io.Copy(io.Discard, rc); err != nil {
 			rc.Close()
-			return fmt.Errorf("extracting layer: %w", err)
+			return nil, fmt.Errorf("reading layer: %w", err)
 		}
 		rc.Close()
+		t.finish(i)
 	}
 
-	return nil
+	if meta != nil {
+		meta.prune(outputDir)
+	}
+	return meta, nil
 }
@@ -0,0 +1,255 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+	mode     int64
+	modTime  time.Time
+	uid, gid int
+	devmajor int64
+	devminor int64
+	pax      map[string]string
+}
+
+func layerTar(t *testing.T, entries ...tarEntry) io.ReadCloser {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		header := &tar.Header{
+			Name: e.name, Typeflag: e.typeflag, Mode: e.mode, Size: int64(len(e.body)), Linkname: e.linkname, ModTime: e.modTime,
+			Uid: e.uid, Gid: e.gid, Devmajor: e.devmajor, Devminor: e.devminor, PAXRecords: e.pax,
+		}
+		if header.Mode == 0 {
+			header.Mode = 0644
+			if e.typeflag == tar.TypeDir {
+				header.Mode = 0755
+			}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatalf("writing tar header: %v", err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatalf("writing tar body: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("closing tar: %v", err)
+	}
+	return io.NopCloser(&buf)
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func TestExtractWhiteouts(t *testing.T) {
+	root := t.TempDir()
+
+	lower := layerTar(t,
+		tarEntry{name: "etc/", typeflag: tar.TypeDir},
+		tarEntry{name: "etc/removed", typeflag: tar.TypeReg, body: "x"},
+		tarEntry{name: "etc/kept", typeflag: tar.TypeReg, body: "x"},
+		tarEntry{name: "opt/", typeflag: tar.TypeDir},
+		tarEntry{name: "opt/old/", typeflag: tar.TypeDir},
+		tarEntry{name: "opt/old/file", typeflag: tar.TypeReg, body: "x"},
+		tarEntry{name: "opt/stale", typeflag: tar.TypeReg, body: "x"},
+	)
+	if err := extractLayerToRootFS(lower, root, &usage{}, nil); err != nil {
+		t.Fatalf("extracting lower layer: %v", err)
+	}
+
+	upper := layerTar(t,
+		tarEntry{name: "etc/.wh.removed", typeflag: tar.TypeReg},
+		tarEntry{name: "opt/", typeflag: tar.TypeDir},
+		tarEntry{name: "opt/new", typeflag: tar.TypeReg, body: "y"},
+		tarEntry{name: "opt/.wh..wh..opq", typeflag: tar.TypeReg},
+	)
+	if err := extractLayerToRootFS(upper, root, &usage{}, nil); err != nil {
+		t.Fatalf("extracting upper layer: %v", err)
+	}
+
+	for path, want := range map[string]bool{
+		"etc/removed":      false,
+		"etc/.wh.removed":  false,
+		"etc/kept":         true,
+		"opt/old":          false,
+		"opt/stale":        false,
+		"opt/new":          true,
+		"opt/.wh..wh..opq": false,
+	} {
+		if got := exists(filepath.Join(root, path)); got != want {
+			t.Errorf("%s exists = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestExtractFileTypes(t *testing.T) {
+	root := t.TempDir()
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	layer := layerTar(t,
+		tarEntry{name: "usr/bin/", typeflag: tar.TypeDir, modTime: mtime},
+		tarEntry{name: "usr/bin/su", typeflag: tar.TypeReg, body: "su", mode: 04755, modTime: mtime},
+		tarEntry{name: "usr/bin/su-link", typeflag: tar.TypeLink, linkname: "usr/bin/su"},
+		tarEntry{name: "run/fifo", typeflag: tar.TypeFifo, mode: 0600},
+	)
+	if err := extractLayerToRootFS(layer, root, &usage{}, nil); err != nil {
+		t.Fatalf("extracting layer: %v", err)
+	}
+
+	su, err := os.Stat(filepath.Join(root, "usr/bin/su"))
+	if err != nil {
+		t.Fatalf("stat su: %v", err)
+	}
+	if su.Mode()&os.ModeSetuid == 0 || su.Mode().Perm() != 0755 {
+		t.Errorf("su mode = %v, want setuid 0755", su.Mode())
+	}
+	if !su.ModTime().Equal(mtime) {
+		t.Errorf("su mtime = %v, want %v", su.ModTime(), mtime)
+	}
+
+	link, err := os.Stat(filepath.Join(root, "usr/bin/su-link"))
+	if err != nil {
+		t.Fatalf("stat su-link: %v", err)
+	}
+	if !os.SameFile(su, link) {
+		t.Errorf("su-link is not a hardlink to su")
+	}
+
+	dir, err := os.Stat(filepath.Join(root, "usr/bin"))
+	if err != nil {
+		t.Fatalf("stat usr/bin: %v", err)
+	}
+	if !dir.ModTime().Equal(mtime) {
+		t.Errorf("usr/bin mtime = %v, want %v", dir.ModTime(), mtime)
+	}
+
+	fifo, err := os.Lstat(filepath.Join(root, "run/fifo"))
+	if err != nil {
+		t.Fatalf("stat fifo: %v", err)
+	}
+	if fifo.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("run/fifo mode = %v, want a named pipe", fifo.Mode())
+	}
+}
+
+func TestExtractRejectsEscapes(t *testing.T) {
+	for name, layer := range map[string][]tarEntry{
+		"dotdot": {
+			{name: "../escaped", typeflag: tar.TypeReg, body: "x"},
+		},
+		"hardlink": {
+			{name: "passwd", typeflag: tar.TypeLink, linkname: "../../etc/passwd"},
+		},
+	} {
+		root := t.TempDir()
+		err := extractLayerToRootFS(layerTar(t, layer...), filepath.Join(root, "rootfs"), &usage{}, nil)
+		if !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("%s: got %v, want ErrUnsafePath", name, err)
+		}
+		if exists(filepath.Join(root, "escaped")) {
+			t.Errorf("%s: file written outside the rootfs", name)
+		}
+	}
+}
+
+func TestExtractConfinesSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	root := t.TempDir()
+
+	layer := layerTar(t,
+		tarEntry{name: "abs", typeflag: tar.TypeSymlink, linkname: outside},
+		tarEntry{name: "rel", typeflag: tar.TypeSymlink, linkname: "../../../../.." + outside},
+		tarEntry{name: "abs/file", typeflag: tar.TypeReg, body: "x"},
+		tarEntry{name: "rel/file", typeflag: tar.TypeReg, body: "x"},
+	)
+	if err := extractLayerToRootFS(layer, root, &usage{}, nil); err != nil {
+		t.Fatalf("extracting layer: %v", err)
+	}
+
+	if exists(filepath.Join(outside, "file")) {
+		t.Errorf("symlinked entry was written outside the rootfs")
+	}
+	if !exists(filepath.Join(root, outside, "file")) {
+		t.Errorf("symlinked entry should resolve inside the rootfs")
+	}
+}
+
+func TestExtractLimits(t *testing.T) {
+	layer := layerTar(t,
+		tarEntry{name: "a", typeflag: tar.TypeReg, body: "1234"},
+		tarEntry{name: "b", typeflag: tar.TypeReg, body: "5678"},
+	)
+	err := extractLayerToRootFS(layer, t.TempDir(), &usage{limits: Limits{MaxBytes: 6}}, nil)
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("got %v, want ErrLimitExceeded", err)
+	}
+
+	layer = layerTar(t,
+		tarEntry{name: "a", typeflag: tar.TypeReg},
+		tarEntry{name: "b", typeflag: tar.TypeReg},
+	)
+	err = extractLayerToRootFS(layer, t.TempDir(), &usage{limits: Limits{MaxEntries: 1}}, nil)
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("got %v, want ErrLimitExceeded", err)
+	}
+}
+
+func TestExtractRecordsMetadata(t *testing.T) {
+	defer func(f func() bool) { isRoot = f }(isRoot)
+	isRoot = func() bool { return false }
+
+	root := t.TempDir()
+	lower := layerTar(t,
+		tarEntry{name: "etc/", typeflag: tar.TypeDir},
+		tarEntry{name: "etc/shadow", typeflag: tar.TypeReg, body: "x", mode: 0640, gid: 42},
+		tarEntry{name: "home/app/", typeflag: tar.TypeDir, uid: 1000, gid: 1000},
+		tarEntry{name: "home/app/data", typeflag: tar.TypeReg, body: "x", uid: 1000, gid: 1000},
+		tarEntry{name: "usr/bin/ping", typeflag: tar.TypeReg, body: "x", mode: 04755, pax: map[string]string{
+			xattrPAXPrefix + "trusted.test": "y",
+		}},
+		tarEntry{name: "usr/bin/ping6", typeflag: tar.TypeLink, linkname: "usr/bin/ping"},
+		tarEntry{name: "dev/null", typeflag: tar.TypeChar, mode: 0666, devmajor: 1, devminor: 3},
+		tarEntry{name: "opt/old", typeflag: tar.TypeReg, body: "x", uid: 7},
+	)
+	meta := Metadata{}
+	if err := extractLayerToRootFS(lower, root, &usage{}, meta); err != nil {
+		t.Fatalf("extracting lower layer: %v", err)
+	}
+	upper := layerTar(t,
+		tarEntry{name: "opt/.wh.old", typeflag: tar.TypeReg},
+	)
+	if err := extractLayerToRootFS(upper, root, &usage{}, meta); err != nil {
+		t.Fatalf("extracting upper layer: %v", err)
+	}
+	meta.prune(root)
+
+	want := Metadata{
+		"/etc":           {Mode: 040755},
+		"/etc/shadow":    {GID: 42, Mode: 0100640},
+		"/home/app":      {UID: 1000, GID: 1000, Mode: 040755},
+		"/home/app/data": {UID: 1000, GID: 1000, Mode: 0100644},
+		"/usr/bin/ping":  {Mode: 0104755, Xattrs: map[string]string{"trusted.test": "y"}},
+		"/usr/bin/ping6": {Mode: 0104755, Xattrs: map[string]string{"trusted.test": "y"}},
+		"/dev/null":      {Mode: 020666, Major: 1, Minor: 3},
+	}
+	if !reflect.DeepEqual(meta, want) {
+		t.Errorf("recorded metadata %+v, want %+v", meta, want)
+	}
+}
@@ -0,0 +1,273 @@
+package rootfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+)
+
+var ErrImageNotFound = errors.New("image not found")
+
+// Image describes an image in the cache.
+type Image struct {
+	Digest string `json:"digest"`
+	// Refs are the references that resolved to the image when it was
+	// pulled.
+	Refs     []string `json:"refs"`
+	Platform string   `json:"platform"`
+	// Platforms lists every platform the inspected reference is cached
+	// for. It is only set by Inspect.
+	Platforms []string `json:"platforms,omitempty"`
+	// Size is the compressed size of the config and layers, as pulled
+	// from the registry.
+	Size   int64          `json:"size"`
+	Layers []Layer        `json:"layers"`
+	Config *v1.ConfigFile `json:"config,omitempty" swaggertype:"object"`
+}
+
+type Layer struct {
+	Digest    string `json:"digest"`
+	DiffID    string `json:"diff_id"`
+	MediaType string `json:"media_type"`
+	Size      int64  `json:"size"`
+}
+
+// Images lists the cached images, without their config files.
+func (c *Cache) Images() ([]Image, error) {
+	entries, err := os.ReadDir(filepath.Join(c.Dir, "manifests"))
+	if os.IsNotExist(err) {
+		return []Image{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing images: %w", err)
+	}
+	refs, err := c.readRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	images := []Image{}
+	for _, entry := range entries {
+		base, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		algorithm, hex, ok := strings.Cut(base, "-")
+		if !ok {
+			continue
+		}
+		img, err := c.image(v1.Hash{Algorithm: algorithm, Hex: hex}, refs)
+		if err != nil {
+			return nil, err
+		}
+		img.Config = nil
+		images = append(images, *img)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Digest < images[j].Digest })
+	return images, nil
+}
+
+// Inspect returns the cached image ref resolves to on platform. ref is a
+// manifest digest, a reference that was pulled before or a local image.
+func (c *Cache) Inspect(ref string, platform v1.Platform) (*Image, error) {
+	digest, name, err := c.lookup(ref, platform)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := c.readRefs()
+	if err != nil {
+		return nil, err
+	}
+	img, err := c.image(digest, refs)
+	if err != nil {
+		return nil, err
+	}
+	if name != "" {
+		for key := range refs {
+			if n, p, _ := strings.Cut(key, " "); n == name {
+				img.Platforms = append(img.Platforms, p)
+			}
+		}
+		sort.Strings(img.Platforms)
+	}
+	return img, nil
+}
+
+// Remove deletes the image ref resolves to on platform from the cache,
+// with every reference to it and the layers no other cached image uses.
+// Machines created from the image are not affected.
+func (c *Cache) Remove(ref string, platform v1.Platform) (*Image, error) {
+	digest, _, err := c.lookup(ref, platform)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := c.lock(digest.String())
+	defer unlock()
+	unlockExt4 := c.lock("ext4:" + digest.String())
+	defer unlockExt4()
+
+	refs, err := c.readRefs()
+	if err != nil {
+		return nil, err
+	}
+	img, err := c.image(digest, refs)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.removeRefs(digest); err != nil {
+		return nil, err
+	}
+	for _, path := range []string{c.manifestPath(digest), c.configPath(digest), c.ext4Path(digest), c.treeDir(digest), MetadataPath(c.treeDir(digest))} {
+		if err := os.RemoveAll(path); err != nil {
+			return nil, fmt.Errorf("removing image: %w", err)
+		}
+	}
+
+	// Layers are shared between images that have them in common.
+	others, err := c.Images()
+	if err != nil {
+		return nil, err
+	}
+	inUse := map[string]bool{}
+	for _, other := range others {
+		for _, l := range other.Layers {
+			inUse[l.Digest] = true
+			inUse[l.DiffID] = true
+		}
+	}
+	layers := cache.NewFilesystemCache(filepath.Join(c.Dir, "layers"))
+	for _, l := range img.Layers {
+		for _, s := range []string{l.Digest, l.DiffID} {
+			h, err := v1.NewHash(s)
+			if err != nil || inUse[s] {
+				continue
+			}
+			if err := layers.Delete(h); err != nil && !errors.Is(err, cache.ErrNotFound) {
+				return nil, fmt.Errorf("removing layer: %w", err)
+			}
+		}
+	}
+
+	img.Config = nil
+	return img, nil
+}
+
+// lookup returns the digest of the cached image ref resolves to, and the
+// name it is kept under in refs.json if ref is a reference.
+func (c *Cache) lookup(ref string, platform v1.Platform) (v1.Hash, string, error) {
+	if digest, err := v1.NewHash(ref); err == nil {
+		if _, err := os.Stat(c.manifestPath(digest)); err != nil {
+			return v1.Hash{}, "", fmt.Errorf("%w: %s", ErrImageNotFound, ref)
+		}
+		return digest, "", nil
+	}
+
+	if img, ok, err := localImage(ref, platform); ok {
+		if err != nil {
+			return v1.Hash{}, "", err
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			return v1.Hash{}, "", fmt.Errorf("getting image digest: %w", err)
+		}
+		if _, err := os.Stat(c.manifestPath(digest)); err != nil {
+			return v1.Hash{}, "", fmt.Errorf("%w: %s", ErrImageNotFound, ref)
+		}
+		return digest, "", nil
+	}
+
+	r, err := c.Registries.parseReference(ref)
+	if err != nil {
+		return v1.Hash{}, "", err
+	}
+	refs, err := c.readRefs()
+	if err != nil {
+		return v1.Hash{}, "", err
+	}
+	s, ok := refs[refKey(r, platform)]
+	if !ok {
+		return v1.Hash{}, "", fmt.Errorf("%w: %s for %s", ErrImageNotFound, ref, platform)
+	}
+	digest, err := v1.NewHash(s)
+	if err != nil {
+		return v1.Hash{}, "", fmt.Errorf("reading image refs: %w", err)
+	}
+	if _, err := os.Stat(c.manifestPath(digest)); err != nil {
+		return v1.Hash{}, "", fmt.Errorf("%w: %s", ErrImageNotFound, ref)
+	}
+	return digest, r.Name(), nil
+}
+
+// image reads the stored manifest and config file of digest.
+func (c *Cache) image(digest v1.Hash, refs map[string]string) (*Image, error) {
+	f, err := os.Open(c.manifestPath(digest))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrImageNotFound, digest)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading image manifest: %w", err)
+	}
+	defer f.Close()
+	manifest, err := v1.ParseManifest(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading image manifest: %w", err)
+	}
+	config, err := c.ConfigFile(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{
+		Digest: digest.String(),
+		Refs:   []string{},
+		Size:   manifest.Config.Size,
+		Layers: []Layer{},
+		Config: config,
+	}
+	if p := config.Platform(); p != nil {
+		img.Platform = p.String()
+	}
+	for i, l := range manifest.Layers {
+		layer := Layer{Digest: l.Digest.String(), MediaType: string(l.MediaType), Size: l.Size}
+		if i < len(config.RootFS.DiffIDs) {
+			layer.DiffID = config.RootFS.DiffIDs[i].String()
+		}
+		img.Layers = append(img.Layers, layer)
+		img.Size += l.Size
+	}
+	for key, d := range refs {
+		if d == digest.String() {
+			name, _, _ := strings.Cut(key, " ")
+			img.Refs = append(img.Refs, name)
+		}
+	}
+	sort.Strings(img.Refs)
+	img.Refs = slices.Compact(img.Refs)
+	return img, nil
+}
+
+// removeRefs forgets every reference that resolves to digest.
+func (c *Cache) removeRefs(digest v1.Hash) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	refs, err := c.readRefsLocked()
+	if err != nil {
+		return err
+	}
+	for key, d := range refs {
+		if d == digest.String() {
+			delete(refs, key)
+		}
+	}
+	return c.writeRefsLocked(refs)
+}
@@ -0,0 +1,149 @@
+package rootfs
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestCacheImages(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	c := NewCache(t.TempDir())
+	digests := map[string]v1.Hash{}
+	for _, repo := range []string{"first", "second"} {
+		img, err := random.Image(1024, 2)
+		if err != nil {
+			t.Fatalf("creating image: %v", err)
+		}
+		imageName := fmt.Sprintf("%s/test/%s:latest", host, repo)
+		ref, err := name.ParseReference(imageName)
+		if err != nil {
+			t.Fatalf("parsing reference: %v", err)
+		}
+		if err := remote.Write(ref, img); err != nil {
+			t.Fatalf("pushing image: %v", err)
+		}
+		if _, digests[repo], err = c.Tree(imageName, PullOptions{}); err != nil {
+			t.Fatalf("Tree failed: %v", err)
+		}
+	}
+
+	images, err := c.Images()
+	if err != nil {
+		t.Fatalf("Images failed: %v", err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("got %d images, want 2", len(images))
+	}
+	for _, img := range images {
+		if len(img.Refs) != 1 || len(img.Layers) != 2 || img.Size == 0 || img.Config != nil {
+			t.Errorf("unexpected image %+v", img)
+		}
+	}
+
+	first := host + "/test/first:latest"
+	img, err := c.Inspect(first, HostPlatform())
+	if err != nil {
+		t.Fatalf("Inspect failed: %v", err)
+	}
+	if img.Digest != digests["first"].String() {
+		t.Errorf("digest = %s, want %s", img.Digest, digests["first"])
+	}
+	if img.Config == nil {
+		t.Error("Inspect didn't return the config file")
+	}
+	if len(img.Platforms) != 1 || img.Platforms[0] != HostPlatform().String() {
+		t.Errorf("platforms = %q", img.Platforms)
+	}
+	if _, err := c.Inspect(digests["second"].String(), HostPlatform()); err != nil {
+		t.Errorf("Inspect by digest failed: %v", err)
+	}
+
+	// Extraction caches the layers as pulled.
+	for _, l := range img.Layers {
+		if _, err := os.Stat(filepath.Join(c.Dir, "layers", l.Digest)); err != nil {
+			t.Fatalf("layer %s isn't cached: %v", l.Digest, err)
+		}
+	}
+	if _, err := c.Remove(first, HostPlatform()); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if _, err := c.Inspect(first, HostPlatform()); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("Inspect after Remove: got %v, want ErrImageNotFound", err)
+	}
+	if _, err := os.Stat(c.treeDir(digests["first"])); !os.IsNotExist(err) {
+		t.Errorf("tree still exists: %v", err)
+	}
+	for _, l := range img.Layers {
+		if _, err := os.Stat(filepath.Join(c.Dir, "layers", l.Digest)); !os.IsNotExist(err) {
+			t.Errorf("layer %s still exists: %v", l.Digest, err)
+		}
+	}
+	if images, err := c.Images(); err != nil || len(images) != 1 {
+		t.Errorf("got %d images after Remove: %v", len(images), err)
+	}
+
+	// The image can be pulled again.
+	if _, _, err := c.Tree(first, PullOptions{}); err != nil {
+		t.Errorf("Tree after Remove failed: %v", err)
+	}
+}
+
+func TestCacheExt4AfterRemove(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	imageName := strings.TrimPrefix(server.URL, "http://") + "/test/image:latest"
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("creating image: %v", err)
+	}
+	ref, err := name.ParseReference(imageName)
+	if err != nil {
+		t.Fatalf("parsing reference: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("pushing image: %v", err)
+	}
+
+	c := NewCache(t.TempDir())
+	builds := 0
+	build := func(tree, output string) error {
+		builds++
+		if _, err := os.Stat(tree); err != nil {
+			return err
+		}
+		return os.WriteFile(output, nil, 0644)
+	}
+
+	// An image removed between resolving its tree and building it isn't
+	// built from the missing tree.
+	tree, digest, err := c.Tree(imageName, PullOptions{})
+	if err != nil {
+		t.Fatalf("Tree failed: %v", err)
+	}
+	if _, err := c.Remove(imageName, HostPlatform()); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if _, ok, err := c.ext4(tree, digest, build); ok || err != nil || builds != 0 {
+		t.Errorf("ext4 after Remove: got %v, %v with %d builds", ok, err, builds)
+	}
+
+	// Ext4 pulls it again instead.
+	if _, _, err := c.Ext4(imageName, PullOptions{}, build); err != nil || builds != 1 {
+		t.Errorf("Ext4 failed: %v with %d builds", err, builds)
+	}
+}
@@ -0,0 +1,164 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// FileMetadata is the ownership, mode and xattrs of a tar entry as recorded
+// in its header.
+type FileMetadata struct {
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+	// Mode is the st_mode, file type included.
+	Mode   uint32            `json:"mode"`
+	Xattrs map[string]string `json:"xattrs,omitempty"`
+	// Major and Minor number device nodes.
+	Major int64 `json:"major,omitempty"`
+	Minor int64 `json:"minor,omitempty"`
+}
+
+func (m FileMetadata) device() bool {
+	return m.Mode&unix.S_IFMT == unix.S_IFCHR || m.Mode&unix.S_IFMT == unix.S_IFBLK
+}
+
+// Metadata maps paths in an extracted tree, rooted at "/", to the metadata
+// their tar headers recorded.
+//
+// Without root, extraction can't apply ownership or privileged xattrs, nor
+// create device nodes. It records them instead, and CreateExt4Image applies
+// them to the image, so the guest sees the files as the image has them.
+// Directories the layers didn't list are missing and belong to root.
+type Metadata map[string]FileMetadata
+
+// MetadataPath is where the metadata of the tree is kept, next to it so it
+// doesn't end up in the image.
+func MetadataPath(tree string) string {
+	return filepath.Clean(tree) + ".metadata.json"
+}
+
+// ReadMetadata returns the metadata recorded for tree, or nil if its
+// extraction applied everything.
+func ReadMetadata(tree string) (Metadata, error) {
+	data, err := os.ReadFile(MetadataPath(tree))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading tree metadata: %w", err)
+	}
+	var m Metadata
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("reading tree metadata: %w", err)
+	}
+	return m, nil
+}
+
+func (m Metadata) write(tree string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("encoding tree metadata: %w", err)
+	}
+	if err := writeFile(MetadataPath(tree), data); err != nil {
+		return fmt.Errorf("storing tree metadata: %w", err)
+	}
+	return nil
+}
+
+// metadataKey returns the key of path in the tree at root.
+func metadataKey(root, p string) string {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return ""
+	}
+	return path.Join("/", filepath.ToSlash(rel))
+}
+
+// record stores the metadata of the entry extracted to key. Hardlinks share
+// the metadata of their target.
+func (m Metadata) record(key string, header *tar.Header, target string) {
+	if header.Typeflag == tar.TypeLink {
+		if md, ok := m[target]; ok {
+			m[key] = md
+		}
+		return
+	}
+
+	var kind uint32
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		kind = unix.S_IFREG
+	case tar.TypeDir:
+		kind = unix.S_IFDIR
+	case tar.TypeSymlink:
+		kind = unix.S_IFLNK
+	case tar.TypeChar:
+		kind = unix.S_IFCHR
+	case tar.TypeBlock:
+		kind = unix.S_IFBLK
+	case tar.TypeFifo:
+		kind = unix.S_IFIFO
+	default:
+		return
+	}
+
+	md := FileMetadata{UID: header.Uid, GID: header.Gid, Mode: kind | uint32(header.Mode)&07777}
+	if kind == unix.S_IFCHR || kind == unix.S_IFBLK {
+		md.Major, md.Minor = header.Devmajor, header.Devminor
+	}
+	for k, v := range header.PAXRecords {
+		if attr, ok := strings.CutPrefix(k, xattrPAXPrefix); ok {
+			if md.Xattrs == nil {
+				md.Xattrs = map[string]string{}
+			}
+			md.Xattrs[attr] = v
+		}
+	}
+	m[key] = md
+}
+
+// remove forgets key and everything below it.
+func (m Metadata) remove(key string) {
+	for k := range m {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(m, k)
+		}
+	}
+}
+
+// removeLower forgets everything below dir that the current layer didn't
+// extract, like removeLowerEntries does on disk.
+func (m Metadata) removeLower(root, dir string, extracted map[string]bool) {
+	prefix := metadataKey(root, dir) + "/"
+	if prefix == "//" {
+		prefix = "/"
+	}
+	for k := range m {
+		if strings.HasPrefix(k, prefix) && !extracted[filepath.Join(root, filepath.FromSlash(k))] {
+			delete(m, k)
+		}
+	}
+}
+
+// prune forgets entries a later layer replaced by something else, such as
+// the contents of a directory that became a file. Device nodes only exist
+// in the metadata and are kept as long as their directory exists.
+func (m Metadata) prune(root string) {
+	for k, md := range m {
+		p := filepath.Join(root, filepath.FromSlash(k))
+		if md.device() {
+			p = filepath.Dir(p)
+		}
+		fi, err := os.Lstat(p)
+		if err != nil || (md.device() && !fi.IsDir()) {
+			delete(m, k)
+		}
+	}
+}
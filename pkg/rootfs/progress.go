@@ -0,0 +1,237 @@
+package rootfs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/klauspost/compress/zstd"
+)
+
+// progressInterval rate limits progress updates while layers are read.
+const progressInterval = 250 * time.Millisecond
+
+// LayerProgress is how much of one layer has been pulled and extracted.
+// Bytes are counted as sent by the registry, usually compressed.
+type LayerProgress struct {
+	Digest   string `json:"digest"`
+	Size     int64  `json:"size"`
+	Complete int64  `json:"complete"`
+	Done     bool   `json:"done"`
+}
+
+// Progress reports the pull of an image layer by layer.
+type Progress struct {
+	Digest   string          `json:"digest"`
+	Size     int64           `json:"size"`
+	Complete int64           `json:"complete"`
+	Layers   []LayerProgress `json:"layers"`
+	// UpdatedAt is when bytes were last read, to tell a slow pull from
+	// one that is stuck.
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ProgressFunc receives the progress of a pull. It is called from the
+// pulling goroutine and must not block.
+type ProgressFunc func(Progress)
+
+// tracker fans the progress of extracting one image out to every caller
+// waiting for it.
+type tracker struct {
+	mu          sync.Mutex
+	progress    Progress
+	subscribers map[int]ProgressFunc
+	next        int
+	reported    time.Time
+	// refs counts subscribers and extractions using the tracker.
+	refs int
+}
+
+// watch calls fn with the progress of extracting digest until the returned
+// func is called. A caller waiting for another caller's pull of the same
+// image sees its progress too.
+func (c *Cache) watch(digest v1.Hash, fn ProgressFunc) func() {
+	t := c.tracker(digest)
+	t.mu.Lock()
+	id := t.next
+	t.next++
+	t.subscribers[id] = fn
+	if len(t.progress.Layers) > 0 {
+		fn(t.snapshot())
+	}
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		delete(t.subscribers, id)
+		t.mu.Unlock()
+		c.releaseTracker(digest)
+	}
+}
+
+// tracker returns the tracker of digest, creating it if needed. Every call
+// must be paired with releaseTracker.
+func (c *Cache) tracker(digest v1.Hash) *tracker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.trackers[digest.String()]
+	if !ok {
+		t = &tracker{progress: Progress{Digest: digest.String()}, subscribers: map[int]ProgressFunc{}}
+		c.trackers[digest.String()] = t
+	}
+	t.refs++
+	return t
+}
+
+func (c *Cache) releaseTracker(digest v1.Hash) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := c.trackers[digest.String()]
+	t.refs--
+	if t.refs == 0 {
+		delete(c.trackers, digest.String())
+	}
+}
+
+// start resets the progress to the layers about to be extracted.
+func (t *tracker) start(layers []v1.Layer) error {
+	progress := make([]LayerProgress, len(layers))
+	for i, l := range layers {
+		digest, err := l.Digest()
+		if err != nil {
+			return fmt.Errorf("getting layer digest: %w", err)
+		}
+		size, err := l.Size()
+		if err != nil {
+			return fmt.Errorf("getting layer size: %w", err)
+		}
+		progress[i] = LayerProgress{Digest: digest.String(), Size: size}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress.Layers = progress
+	t.progress.UpdatedAt = time.Now()
+	t.report(true)
+	return nil
+}
+
+// add counts n bytes read from layer i.
+func (t *tracker) add(i int, n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress.Layers[i].Complete += n
+	t.progress.UpdatedAt = time.Now()
+	t.report(false)
+}
+
+// finish marks layer i as extracted.
+func (t *tracker) finish(i int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress.Layers[i].Done = true
+	t.report(true)
+}
+
+// report sends the progress to the subscribers, at most every
+// progressInterval unless force is set. The caller holds t.mu.
+func (t *tracker) report(force bool) {
+	if !force && time.Since(t.reported) < progressInterval {
+		return
+	}
+	t.reported = time.Now()
+	p := t.snapshot()
+	for _, fn := range t.subscribers {
+		fn(p)
+	}
+}
+
+// snapshot returns a copy of the progress with its totals. The caller holds
+// t.mu.
+func (t *tracker) snapshot() Progress {
+	p := t.progress
+	p.Layers = append([]LayerProgress(nil), p.Layers...)
+	p.Size, p.Complete = 0, 0
+	for _, l := range p.Layers {
+		p.Size += l.Size
+		p.Complete += l.Complete
+	}
+	return p
+}
+
+type countingReader struct {
+	r   io.Reader
+	add func(int64)
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.add(int64(n))
+	}
+	return n, err
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (rc readCloser) Close() error {
+	return rc.close()
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// uncompressedLayer returns the layer's tar stream. Reading it calls add
+// with the number of bytes read from the layer as pulled, so progress can be
+// compared to the layer's size.
+func uncompressedLayer(layer v1.Layer, add func(int64)) (io.ReadCloser, error) {
+	mediaType, err := layer.MediaType()
+	if err != nil {
+		return nil, fmt.Errorf("getting layer media type: %w", err)
+	}
+	if mediaType == types.OCIUncompressedLayer || mediaType == types.OCIUncompressedRestrictedLayer {
+		rc, err := layer.Uncompressed()
+		if err != nil {
+			return nil, err
+		}
+		return readCloser{&countingReader{r: rc, add: add}, rc.Close}, nil
+	}
+
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(&countingReader{r: rc, add: add})
+	magic, _ := br.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("decompressing layer: %w", err)
+		}
+		return readCloser{zr, func() error { zr.Close(); return rc.Close() }}, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("decompressing layer: %w", err)
+		}
+		return readCloser{zr, func() error { zr.Close(); return rc.Close() }}, nil
+	default:
+		return readCloser{br, rc.Close}, nil
+	}
+}
@@ -0,0 +1,73 @@
+package rootfs
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestCacheTreeProgress(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+
+	img, err := random.Image(64<<10, 3)
+	if err != nil {
+		t.Fatalf("creating image: %v", err)
+	}
+	imageName := fmt.Sprintf("%s/test/image:latest", strings.TrimPrefix(server.URL, "http://"))
+	ref, err := name.ParseReference(imageName)
+	if err != nil {
+		t.Fatalf("parsing reference: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("pushing image: %v", err)
+	}
+
+	var updates []Progress
+	c := NewCache(t.TempDir())
+	_, digest, err := c.Tree(imageName, PullOptions{Progress: func(p Progress) {
+		updates = append(updates, p)
+	}})
+	if err != nil {
+		t.Fatalf("Tree failed: %v", err)
+	}
+	if len(updates) < 4 {
+		t.Fatalf("got %d updates, want one per layer and the start", len(updates))
+	}
+
+	first, last := updates[0], updates[len(updates)-1]
+	if first.Complete != 0 || len(first.Layers) != 3 {
+		t.Errorf("first update = %+v", first)
+	}
+	if last.Digest != digest.String() {
+		t.Errorf("digest = %s, want %s", last.Digest, digest)
+	}
+	if last.Size == 0 || last.Complete != last.Size {
+		t.Errorf("completed %d of %d bytes", last.Complete, last.Size)
+	}
+	for _, l := range last.Layers {
+		if !l.Done || l.Complete != l.Size {
+			t.Errorf("layer %+v isn't complete", l)
+		}
+	}
+	if len(c.trackers) != 0 {
+		t.Errorf("%d trackers left", len(c.trackers))
+	}
+
+	// Cached images have nothing to report.
+	updates = nil
+	if _, _, err := c.Tree(imageName, PullOptions{Progress: func(p Progress) {
+		updates = append(updates, p)
+	}}); err != nil {
+		t.Fatalf("Tree failed: %v", err)
+	}
+	if len(updates) != 0 {
+		t.Errorf("got %d updates for a cached image", len(updates))
+	}
+}
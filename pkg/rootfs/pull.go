@@ -0,0 +1,215 @@
+package rootfs
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+var ErrPlatformNotFound = errors.New("image is not available for platform")
+
+// PullOptions control how an image is fetched.
+type PullOptions struct {
+	// Platform selects the image from multi-platform indexes. It defaults
+	// to HostPlatform.
+	Platform *v1.Platform
+	// Auth authenticates this pull instead of the server's docker
+	// credentials.
+	Auth authn.Authenticator
+	// Progress receives the progress of extracting the image while it is
+	// pulled, including pulls of the same image by other callers.
+	Progress ProgressFunc
+	// Refresh resolves tags with the registry even if they were resolved
+	// before, to pick up tags that were moved to another image.
+	Refresh bool
+}
+
+// HostPlatform is the platform of the host the server runs on.
+func HostPlatform() v1.Platform {
+	return v1.Platform{OS: "linux", Architecture: runtime.GOARCH}
+}
+
+func (o PullOptions) platform() v1.Platform {
+	if o.Platform != nil {
+		return *o.Platform
+	}
+	return HostPlatform()
+}
+
+func (o PullOptions) remoteOptions() []remote.Option {
+	if o.Auth != nil {
+		return []remote.Option{remote.WithAuth(o.Auth)}
+	}
+	return []remote.Option{remote.WithAuthFromKeychain(authn.DefaultKeychain)}
+}
+
+// fetchImage gets the image for the requested platform from the registry.
+func (r RegistryConfig) fetchImage(ref name.Reference, opts PullOptions) (v1.Image, error) {
+	platform := opts.platform()
+
+	desc, err := remote.Get(ref, r.remoteOptions(ref, opts)...)
+	if err != nil {
+		return nil, fmt.Errorf("getting image: %w", err)
+	}
+
+	if desc.MediaType.IsIndex() {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return nil, fmt.Errorf("getting image index: %w", err)
+		}
+		manifest, err := idx.IndexManifest()
+		if err != nil {
+			return nil, fmt.Errorf("getting image index: %w", err)
+		}
+		return imageForPlatform(idx, manifest.Manifests, platform, ref.String())
+	}
+
+	img, err := desc.Image()
+	if err != nil {
+		return nil, fmt.Errorf("getting image: %w", err)
+	}
+	if err := checkPlatform(img, platform, ref.String()); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// imageForPlatform picks the image for platform among the manifests of an
+// index, descending into nested indexes.
+func imageForPlatform(idx v1.ImageIndex, manifests []v1.Descriptor, platform v1.Platform, source string) (v1.Image, error) {
+	var available []string
+	for _, m := range manifests {
+		switch {
+		case m.MediaType.IsIndex():
+			child, err := idx.ImageIndex(m.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("getting image index: %w", err)
+			}
+			childManifest, err := child.IndexManifest()
+			if err != nil {
+				return nil, fmt.Errorf("getting image index: %w", err)
+			}
+			img, err := imageForPlatform(child, childManifest.Manifests, platform, source)
+			if !errors.Is(err, ErrPlatformNotFound) {
+				return img, err
+			}
+		case m.Platform != nil:
+			if m.Platform.Satisfies(platform) {
+				img, err := idx.Image(m.Digest)
+				if err != nil {
+					return nil, fmt.Errorf("getting image: %w", err)
+				}
+				return img, nil
+			}
+			available = append(available, m.Platform.String())
+		default:
+			img, err := idx.Image(m.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("getting image: %w", err)
+			}
+			err = checkPlatform(img, platform, source)
+			if !errors.Is(err, ErrPlatformNotFound) {
+				return img, err
+			}
+		}
+	}
+	if len(available) > 0 {
+		return nil, fmt.Errorf("%w %s: %s only has %s", ErrPlatformNotFound, platform, source, strings.Join(available, ", "))
+	}
+	return nil, fmt.Errorf("%w %s: %s has no image for it", ErrPlatformNotFound, platform, source)
+}
+
+// checkPlatform makes sure a single image is built for platform. Images
+// that don't record their platform are accepted.
+func checkPlatform(img v1.Image, platform v1.Platform, source string) error {
+	config, err := img.ConfigFile()
+	if err != nil {
+		return fmt.Errorf("getting image config: %w", err)
+	}
+	if p := config.Platform(); p != nil && !p.Satisfies(platform) {
+		return fmt.Errorf("%w %s: %s is %s", ErrPlatformNotFound, platform, source, p)
+	}
+	return nil
+}
+
+// Image references that point at local files instead of a registry.
+const (
+	ociLayoutPrefix     = "oci-layout:"
+	dockerArchivePrefix = "docker-archive:"
+)
+
+// localImage loads the image for oci-layout:/path[:tag] and
+// docker-archive:/path.tar[:reference] image names. ok is false for
+// registry references.
+func localImage(imageName string, platform v1.Platform) (img v1.Image, ok bool, err error) {
+	switch {
+	case strings.HasPrefix(imageName, ociLayoutPrefix):
+		path, tag, _ := strings.Cut(strings.TrimPrefix(imageName, ociLayoutPrefix), ":")
+		img, err := layoutImage(path, tag, platform)
+		return img, true, err
+	case strings.HasPrefix(imageName, dockerArchivePrefix):
+		path, tag, _ := strings.Cut(strings.TrimPrefix(imageName, dockerArchivePrefix), ":")
+		img, err := archiveImage(path, tag, platform)
+		return img, true, err
+	}
+	return nil, false, nil
+}
+
+// layoutImage loads the image tagged tag from an OCI image layout, or its
+// only image if tag is empty.
+func layoutImage(path, tag string, platform v1.Platform) (v1.Image, error) {
+	idx, err := layout.ImageIndexFromPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading OCI layout %s: %w", path, err)
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("reading OCI layout %s: %w", path, err)
+	}
+
+	manifests := manifest.Manifests
+	if tag != "" {
+		manifests = nil
+		for _, m := range manifest.Manifests {
+			if m.Annotations[ociRefNameAnnotation] == tag {
+				manifests = append(manifests, m)
+			}
+		}
+		if len(manifests) == 0 {
+			return nil, fmt.Errorf("OCI layout %s has no image tagged %q", path, tag)
+		}
+	}
+	return imageForPlatform(idx, manifests, platform, ociLayoutPrefix+path)
+}
+
+// ociRefNameAnnotation holds the tag of an image in an OCI layout.
+const ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// archiveImage loads an image from a docker save tarball. The reference is
+// only needed when the archive holds more than one image.
+func archiveImage(path, reference string, platform v1.Platform) (v1.Image, error) {
+	var tag *name.Tag
+	if reference != "" {
+		t, err := name.NewTag(reference)
+		if err != nil {
+			return nil, fmt.Errorf("parsing reference: %w", err)
+		}
+		tag = &t
+	}
+	img, err := tarball.ImageFromPath(path, tag)
+	if err != nil {
+		return nil, fmt.Errorf("reading docker archive %s: %w", path, err)
+	}
+	if err := checkPlatform(img, platform, dockerArchivePrefix+path); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
@@ -0,0 +1,127 @@
+package rootfs
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/sirupsen/logrus"
+)
+
+// RegistryConfig is the server-wide registry setup.
+type RegistryConfig struct {
+	// Mirrors maps a registry (docker.io for Docker Hub) to mirrors that
+	// are tried in order before the registry itself.
+	Mirrors map[string][]string
+	// Insecure registries are reached over plain HTTP, or over HTTPS
+	// without verifying their certificate.
+	Insecure []string
+}
+
+// AddMirror adds a mirror given as registry=mirror.
+func (r *RegistryConfig) AddMirror(spec string) error {
+	registry, mirror, ok := strings.Cut(spec, "=")
+	if !ok || registry == "" || mirror == "" {
+		return fmt.Errorf("registry mirror %q is not registry=mirror", spec)
+	}
+	if _, err := name.NewRegistry(mirror); err != nil {
+		return fmt.Errorf("invalid registry mirror %q: %w", mirror, err)
+	}
+	key, err := registryName(registry)
+	if err != nil {
+		return fmt.Errorf("invalid registry %q: %w", registry, err)
+	}
+	if r.Mirrors == nil {
+		r.Mirrors = map[string][]string{}
+	}
+	r.Mirrors[key] = append(r.Mirrors[key], mirror)
+	return nil
+}
+
+// registryName normalizes a registry name, e.g. docker.io to
+// index.docker.io.
+func registryName(registry string) (string, error) {
+	reg, err := name.NewRegistry(registry)
+	if err != nil {
+		return "", err
+	}
+	return reg.RegistryStr(), nil
+}
+
+func (r RegistryConfig) insecure(registry string) bool {
+	for _, insecure := range r.Insecure {
+		if n, err := registryName(insecure); err == nil && n == registry {
+			return true
+		}
+	}
+	return false
+}
+
+func (r RegistryConfig) nameOptions(registry string) []name.Option {
+	if r.insecure(registry) {
+		return []name.Option{name.Insecure}
+	}
+	return nil
+}
+
+// parseReference parses an image name, marking references to insecure
+// registries as such.
+func (r RegistryConfig) parseReference(imageName string) (name.Reference, error) {
+	ref, err := name.ParseReference(imageName)
+	if err != nil {
+		return nil, fmt.Errorf("parsing reference: %w", err)
+	}
+	if opts := r.nameOptions(ref.Context().RegistryStr()); opts != nil {
+		return name.ParseReference(imageName, opts...)
+	}
+	return ref, nil
+}
+
+// fetch gets the image from the mirrors of its registry, falling back to
+// the registry itself. Pulls with their own credentials skip the mirrors so
+// the credentials only go to the registry they are meant for.
+func (r RegistryConfig) fetch(ref name.Reference, opts PullOptions) (v1.Image, error) {
+	if opts.Auth == nil {
+		for _, mirror := range r.Mirrors[ref.Context().RegistryStr()] {
+			mirrored, err := r.mirrorReference(ref, mirror)
+			if err != nil {
+				logrus.WithError(err).Warnf("Skipping registry mirror %s", mirror)
+				continue
+			}
+			img, err := r.fetchImage(mirrored, opts)
+			if err == nil || errors.Is(err, ErrPlatformNotFound) {
+				return img, err
+			}
+			logrus.WithError(err).Warnf("Failed to pull %s from mirror %s", ref, mirror)
+		}
+	}
+	return r.fetchImage(ref, opts)
+}
+
+// mirrorReference returns ref with its registry replaced by mirror.
+func (r RegistryConfig) mirrorReference(ref name.Reference, mirror string) (name.Reference, error) {
+	reg, err := name.NewRegistry(mirror, r.nameOptions(mirror)...)
+	if err != nil {
+		return nil, err
+	}
+	repo := reg.Repo(strings.Split(ref.Context().RepositoryStr(), "/")...)
+	if d, ok := ref.(name.Digest); ok {
+		return repo.Digest(d.DigestStr()), nil
+	}
+	return repo.Tag(ref.Identifier()), nil
+}
+
+func (r RegistryConfig) remoteOptions(ref name.Reference, opts PullOptions) []remote.Option {
+	options := opts.remoteOptions()
+	if r.insecure(ref.Context().RegistryStr()) {
+		transport := remote.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		options = append(options, remote.WithTransport(transport))
+	}
+	return options
+}
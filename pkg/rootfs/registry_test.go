@@ -0,0 +1,58 @@
+package rootfs
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestCacheTreeMirrors(t *testing.T) {
+	empty := httptest.NewServer(registry.New())
+	defer empty.Close()
+	mirror := httptest.NewServer(registry.New())
+	defer mirror.Close()
+	host := func(s *httptest.Server) string { return strings.TrimPrefix(s.URL, "http://") }
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("creating image: %v", err)
+	}
+	ref, err := name.ParseReference(host(mirror) + "/library/alpine:3")
+	if err != nil {
+		t.Fatalf("parsing reference: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("pushing image: %v", err)
+	}
+
+	c := NewCache(t.TempDir())
+	for _, spec := range []string{"docker.io=" + host(empty), "docker.io=" + host(mirror)} {
+		if err := c.Registries.AddMirror(spec); err != nil {
+			t.Fatalf("AddMirror failed: %v", err)
+		}
+	}
+
+	// The first mirror doesn't have the image, the second one does and
+	// Docker Hub is never asked.
+	_, digest, err := c.Tree("alpine:3", PullOptions{})
+	if err != nil {
+		t.Fatalf("Tree failed: %v", err)
+	}
+	if want, _ := img.Digest(); digest != want {
+		t.Errorf("digest = %s, want %s", digest, want)
+	}
+}
+
+func TestAddMirrorRejectsMalformedSpecs(t *testing.T) {
+	var r RegistryConfig
+	for _, spec := range []string{"mirror.local:5000", "docker.io=", "=mirror.local"} {
+		if err := r.AddMirror(spec); err == nil {
+			t.Errorf("AddMirror(%q) should fail", spec)
+		}
+	}
+}
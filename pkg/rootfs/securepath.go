@@ -0,0 +1,76 @@
+package rootfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks bounds how many symlinks are followed resolving one path.
+const maxSymlinks = 255
+
+var ErrUnsafePath = errors.New("unsafe path in image")
+
+// securePath returns where the entry called name goes inside root. Names
+// that climb out of the root are rejected. Symlinks in the parent
+// directories are resolved as if root were /, so an earlier entry can't
+// redirect later ones outside of it; the last element is never followed.
+func securePath(root, name string) (string, error) {
+	rel := strings.TrimLeft(name, "/")
+	if rel == "" {
+		return root, nil
+	}
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%w: %q", ErrUnsafePath, name)
+	}
+	rel = filepath.Clean(rel)
+
+	dir, err := resolveInRoot(root, filepath.Dir(rel))
+	if err != nil {
+		return "", fmt.Errorf("resolving %q: %w", name, err)
+	}
+	return filepath.Join(dir, filepath.Base(rel)), nil
+}
+
+// resolveInRoot resolves every symlink in path, treating absolute targets
+// and ".." as relative to root and never leaving it.
+func resolveInRoot(root, path string) (string, error) {
+	resolved := "/"
+	remaining := path
+	links := 0
+	for remaining != "" {
+		var part string
+		part, remaining, _ = strings.Cut(remaining, "/")
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			// Missing directories are created by the caller.
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("%w: too many levels of symlinks", ErrUnsafePath)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = target + "/" + remaining
+	}
+	return filepath.Join(root, resolved), nil
+}
@@ -0,0 +1,134 @@
+package rootfs
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// DefaultHeadroomMB is the free space left in images sized from their
+// content.
+const DefaultHeadroomMB = 512
+
+// mkfs.ext4 defaults the estimate is based on.
+const (
+	ext4BlockSize     = 4096
+	ext4InodeSize     = 256
+	ext4BytesPerInode = 16384
+	// ext4 inlines symlink targets shorter than this in the inode.
+	ext4FastSymlinkMax = 60
+)
+
+// ImageSizeMB estimates how large an ext4 image must be to hold tree, and
+// adds headroomMB of free space on top.
+func ImageSizeMB(tree string, headroomMB int) (int, error) {
+	var blocks, inodes int64
+	seen := map[uint64]bool{}
+	err := filepath.WalkDir(tree, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		// Hardlinked files take space once.
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && !info.IsDir() {
+			if seen[st.Ino] {
+				return nil
+			}
+			seen[st.Ino] = true
+		}
+
+		inodes++
+		switch {
+		case info.IsDir():
+			blocks++
+		case info.Mode().IsRegular():
+			blocks += (info.Size() + ext4BlockSize - 1) / ext4BlockSize
+		case info.Mode()&fs.ModeSymlink != 0 && info.Size() >= ext4FastSymlinkMax:
+			blocks++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("measuring %s: %w", tree, err)
+	}
+
+	data := blocks*ext4BlockSize + inodes*ext4InodeSize
+	// Group descriptors, bitmaps and extent trees take a few percent, and
+	// 5% of the blocks are reserved for root.
+	size := data * 110 / 95
+	size += journalSize(size)
+	// mkfs.ext4 creates one inode per ext4BytesPerInode of space.
+	if min := inodes * ext4BytesPerInode; size < min {
+		size = min
+	}
+
+	const mb = 1 << 20
+	return int((size+mb-1)/mb) + headroomMB, nil
+}
+
+// journalSize mirrors the journal size mkfs.ext4 picks for a file system of
+// the given size.
+func journalSize(size int64) int64 {
+	blocks := size / ext4BlockSize
+	var journal int64
+	switch {
+	case blocks < 2048:
+		journal = 0
+	case blocks < 32768:
+		journal = 1024
+	case blocks < 256*1024:
+		journal = 4096
+	case blocks < 512*1024:
+		journal = 8192
+	case blocks < 4096*1024:
+		journal = 16384
+	case blocks < 8192*1024:
+		journal = 32768
+	case blocks < 16384*1024:
+		journal = 65536
+	case blocks < 32768*1024:
+		journal = 131072
+	default:
+		journal = 262144
+	}
+	return journal * ext4BlockSize
+}
+
+// GrowExt4 adds extraMB of space to the file system in an unmounted image.
+func GrowExt4(imagePath string, extraMB int) error {
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		return fmt.Errorf("resizing image: %w", err)
+	}
+	const mb = 1 << 20
+	return ResizeExt4(imagePath, int((info.Size()+mb-1)/mb)+extraMB)
+}
+
+// ResizeExt4 grows the file system in an unmounted image to sizeMB. Images
+// that are already at least that large are left alone.
+func ResizeExt4(imagePath string, sizeMB int) error {
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		return fmt.Errorf("resizing image: %w", err)
+	}
+	size := int64(sizeMB) << 20
+	if info.Size() >= size {
+		return nil
+	}
+
+	if err := os.Truncate(imagePath, size); err != nil {
+		return fmt.Errorf("resizing image: %w", err)
+	}
+	out, err := exec.Command("resize2fs", imagePath, fmt.Sprintf("%dM", sizeMB)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("resizing file system: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
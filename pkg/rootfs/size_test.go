@@ -0,0 +1,105 @@
+package rootfs
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageSizeMB(t *testing.T) {
+	tree := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tree, "big"), make([]byte, 8<<20), 0644); err != nil {
+		t.Fatalf("writing file: %v", err)
+	}
+	empty, err := ImageSizeMB(tree, 0)
+	if err != nil {
+		t.Fatalf("ImageSizeMB failed: %v", err)
+	}
+	if empty < 8 {
+		t.Errorf("size %dMB can't hold an 8MB file", empty)
+	}
+
+	// Hardlinks don't take more space.
+	if err := os.Link(filepath.Join(tree, "big"), filepath.Join(tree, "link")); err != nil {
+		t.Fatalf("creating hardlink: %v", err)
+	}
+	linked, err := ImageSizeMB(tree, 0)
+	if err != nil {
+		t.Fatalf("ImageSizeMB failed: %v", err)
+	}
+	if linked != empty {
+		t.Errorf("hardlink changed size from %dMB to %dMB", empty, linked)
+	}
+
+	withHeadroom, err := ImageSizeMB(tree, 100)
+	if err != nil {
+		t.Fatalf("ImageSizeMB failed: %v", err)
+	}
+	if withHeadroom != empty+100 {
+		t.Errorf("size with headroom = %dMB, want %dMB", withHeadroom, empty+100)
+	}
+}
+
+func TestResizeExt4(t *testing.T) {
+	for _, tool := range []string{"mkfs.ext4", "resize2fs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not installed", tool)
+		}
+	}
+
+	image := filepath.Join(t.TempDir(), "rootfs.ext4")
+	if err := CreateExt4Image(t.TempDir(), image, 16, BuildMkfs); err != nil {
+		t.Fatalf("CreateExt4Image failed: %v", err)
+	}
+	if err := ResizeExt4(image, 64); err != nil {
+		t.Fatalf("ResizeExt4 failed: %v", err)
+	}
+	info, err := os.Stat(image)
+	if err != nil {
+		t.Fatalf("stat image: %v", err)
+	}
+	if info.Size() != 64<<20 {
+		t.Errorf("image size = %d, want %d", info.Size(), 64<<20)
+	}
+}
+
+func TestGrowExt4(t *testing.T) {
+	for _, tool := range []string{"mkfs.ext4", "resize2fs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not installed", tool)
+		}
+	}
+
+	image := filepath.Join(t.TempDir(), "rootfs.ext4")
+	if err := CreateExt4Image(t.TempDir(), image, 16, BuildMkfs); err != nil {
+		t.Fatalf("CreateExt4Image failed: %v", err)
+	}
+	if err := GrowExt4(image, 48); err != nil {
+		t.Fatalf("GrowExt4 failed: %v", err)
+	}
+	info, err := os.Stat(image)
+	if err != nil {
+		t.Fatalf("stat image: %v", err)
+	}
+	if info.Size() != 64<<20 {
+		t.Errorf("image size = %d, want %d", info.Size(), 64<<20)
+	}
+}
+
+func TestCreateEmptyFileIsSparse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rootfs.ext4")
+	if err := createEmptyFile(path, 1024); err != nil {
+		t.Fatalf("createEmptyFile failed: %v", err)
+	}
+	usage, err := FileDiskUsage(path)
+	if err != nil {
+		t.Fatalf("FileDiskUsage failed: %v", err)
+	}
+	if usage.ApparentBytes != 1024<<20 {
+		t.Errorf("apparent size = %d, want %d", usage.ApparentBytes, 1024<<20)
+	}
+	if usage.AllocatedBytes != 0 {
+		t.Errorf("allocated %d bytes for an empty file", usage.AllocatedBytes)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/sushant12/machine/pkg/proxy"
+)
+
+// Machine metadata keys that route ingress traffic to the machine.
+const (
+	metadataIngressHost       = "ingress.host"
+	metadataIngressPathPrefix = "ingress.path_prefix"
+	metadataIngressPort       = "ingress.port"
+)
+
+var ingress = &proxy.Proxy{
+	Resolve: resolveMachineIP,
+	Done:    releaseMachine,
+	Exists:  machineExists,
+}
+
+// machineExists reports whether the machine has a record. Machines are
+// removed from the store before destroyMachine removes their routes.
+func machineExists(machineID string) bool {
+	_, ok := machines.get(machineID)
+	return ok
+}
+
+// resolveMachineIP returns the address of the machine's primary interface,
+// waking the machine first if auto-stop suspended it.
+func resolveMachineIP(ctx context.Context, machineID string) (net.IP, error) {
+	if err := acquireMachine(ctx, machineID); err != nil {
+		return nil, err
+	}
+	m, _ := machines.get(machineID)
+	if len(m.Interfaces) == 0 {
+		releaseMachine(machineID)
+		return nil, fmt.Errorf("machine %s has no network interfaces", machineID)
+	}
+	return net.ParseIP(m.Interfaces[0].IP), nil
+}
+
+// metadataRoute returns the ingress route configured in the machine's
+// metadata, if any. The port defaults to 80. Its ID is prefixed so it
+// can't collide with the IDs of routes added through the API.
+func metadataRoute(machineID string, metadata map[string]string) (*proxy.Route, error) {
+	host, prefix := metadata[metadataIngressHost], metadata[metadataIngressPathPrefix]
+	if host == "" && prefix == "" {
+		return nil, nil
+	}
+
+	port := 80
+	if p, ok := metadata[metadataIngressPort]; ok {
+		var err error
+		if port, err = strconv.Atoi(p); err != nil {
+			return nil, fmt.Errorf("invalid %s %q", metadataIngressPort, p)
+		}
+	}
+
+	route := &proxy.Route{
+		ID:         "machine-" + machineID,
+		Host:       host,
+		PathPrefix: prefix,
+		MachineID:  machineID,
+		Port:       port,
+	}
+	return route, route.Validate()
+}
+
+type CreateRouteRequest struct {
+	Host       string `json:"host"`
+	PathPrefix string `json:"path_prefix"`
+	MachineID  string `json:"machine_id"`
+	Port       int    `json:"port"`
+}
+
+// @Summary Create an ingress route
+// @Description Routes HTTP requests arriving at the ingress proxy by Host header and/or path prefix to a port on a machine. Routes are removed when the machine is destroyed.
+// @Accept json
+// @Produce json
+// @Param route body CreateRouteRequest true "Route"
+// @Success 200 {object} proxy.Route "Created route"
+// @Failure 400 {string} string "Bad Request"
+// @Failure 404 {string} string "Not Found"
+// @Failure 409 {string} string "Conflict"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /routes [post]
+func createRouteHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreateRouteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logrus.WithError(err).Error("Failed to decode JSON")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := generateNanoID()
+	if err != nil {
+		logrus.WithError(err).Error("Failed to generate route ID")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	route, err := ingress.Add(proxy.Route{
+		ID:         id,
+		Host:       req.Host,
+		PathPrefix: req.PathPrefix,
+		MachineID:  req.MachineID,
+		Port:       req.Port,
+	})
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, proxy.ErrRouteExists) {
+			status = http.StatusConflict
+		} else if errors.Is(err, proxy.ErrNoSuchMachine) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	responseJSON, err := json.Marshal(route)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to marshal response JSON")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+// @Summary List ingress routes
+// @Description Lists the routes of the ingress proxy
+// @Produce json
+// @Success 200 {array} proxy.Route "Routes"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /routes [get]
+func listRoutesHandler(w http.ResponseWriter, r *http.Request) {
+	responseJSON, err := json.Marshal(ingress.List())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to marshal response JSON")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+// @Summary Delete an ingress route
+// @Description Removes a route from the ingress proxy
+// @Param route_id path string true "Route ID"
+// @Success 204 "No Content"
+// @Failure 404 {string} string "Not Found"
+// @Router /routes/{route_id} [delete]
+func deleteRouteHandler(w http.ResponseWriter, r *http.Request) {
+	if !ingress.Remove(mux.Vars(r)["route_id"]) {
+		http.Error(w, "route not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}